@@ -1,11 +1,14 @@
 package starlight
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"unsafe"
 
+	"github.com/starlight-go/starlight/convert"
 	"go.starlark.net/starlark"
 )
 
@@ -20,79 +23,339 @@ import (
 type cache struct {
 	cacheMu  sync.Mutex
 	cache    map[string]*entry
+	deps     map[string]map[string]bool // module -> modules it loads
+	modules  map[string]starlark.StringDict
 	globals  starlark.StringDict
-	readFile func(s string) ([]byte, error)
+	print    func(thread *starlark.Thread, msg string)
+	limits   Limits
+	readFile func(s string) ([]byte, stamp, error)
+	compile  func(filename string, src []byte, predeclared starlark.StringDict) (*starlark.Program, error)
+	resolve  func(from, module string) (string, error)
+	observer Observer
+
+	interceptor convert.Interceptor
+	policy      *convert.Policy
+
+	// reload makes get drop entries whose files have changed, or that failed
+	// to load, and report the dropped modules to onReload.
+	reload   bool
+	onReload func(module string)
 }
 
 type entry struct {
 	owner   unsafe.Pointer // a *cycleChecker; see cycleCheck
 	globals starlark.StringDict
+	stamp   stamp
 	err     error
 	ready   chan struct{}
+	// cancelled is set, before ready is closed, if loading stopped because
+	// the context of the caller loading the module was done.
+	cancelled bool
+}
+
+// isReady reports whether the entry has finished loading.
+func (e *entry) isReady() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Load loads the given module on behalf of the given thread.  Output from the
+// module's print() calls goes to the thread's print function, if it has one.
+// If the module isn't loaded yet, loading it stops when the thread's context
+// (see convert.Context) is done.
+func (c *cache) Load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	return c.get(new(cycleChecker), thread.Print, convert.Context(thread), module)
+}
+
+// register makes the given globals available as a module with the given name.
+func (c *cache) register(module string, globals starlark.StringDict) {
+	c.cacheMu.Lock()
+	if c.modules == nil {
+		c.modules = make(map[string]starlark.StringDict)
+	}
+	c.modules[module] = globals
+	c.cacheMu.Unlock()
+}
+
+// registered reports whether a module with the given name was registered.
+func (c *cache) registered(module string) bool {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	_, ok := c.modules[module]
+	return ok
 }
 
-func (c *cache) Load(module string) (starlark.StringDict, error) {
-	return c.get(new(cycleChecker), module)
+// remove removes the given module and every module that depends on it,
+// directly or indirectly, and returns the names of all the removed modules.
+func (c *cache) remove(module string) []string {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	removed := c.dependentsLocked(module)
+	for _, m := range removed {
+		delete(c.cache, m)
+		delete(c.deps, m)
+	}
+	return removed
+}
+
+// dependentsLocked returns the given module and every module that depends on
+// it, directly or indirectly.  The caller must hold cacheMu.
+func (c *cache) dependentsLocked(module string) []string {
+	seen := map[string]bool{module: true}
+	queue := []string{module}
+	for i := 0; i < len(queue); i++ {
+		for m, deps := range c.deps {
+			if deps[queue[i]] && !seen[m] {
+				seen[m] = true
+				queue = append(queue, m)
+			}
+		}
+	}
+	return queue
+}
+
+// addDep records that module loads dep.
+func (c *cache) addDep(module, dep string) {
+	c.cacheMu.Lock()
+	if c.deps[module] == nil {
+		c.deps[module] = map[string]bool{}
+	}
+	c.deps[module][dep] = true
+	c.cacheMu.Unlock()
+}
+
+// depsOf returns the sorted names of the modules that module loads.
+func (c *cache) depsOf(module string) []string {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	deps := make([]string, 0, len(c.deps[module]))
+	for dep := range c.deps[module] {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// dependentsOf returns the sorted names of the modules that load module.
+func (c *cache) dependentsOf(module string) []string {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	var dependents []string
+	for m, deps := range c.deps {
+		if deps[module] {
+			dependents = append(dependents, m)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// depStampsLocked appends to stamps the stamps of the files of the given
+// module and of every module it loads, directly or indirectly, and returns
+// them.  The caller must hold cacheMu.
+func (c *cache) depStampsLocked(module string, seen map[string]bool, stamps []stamp) []stamp {
+	if seen[module] {
+		return stamps
+	}
+	seen[module] = true
+	if e := c.cache[module]; e != nil && e.isReady() {
+		stamps = append(stamps, e.stamp)
+	}
+	for dep := range c.deps[module] {
+		stamps = c.depStampsLocked(dep, seen, stamps)
+	}
+	return stamps
 }
 
-func (c *cache) remove(module string) {
+// dropStale drops the entry for module if it failed to load, or if its file,
+// or the file of any module it loads, has changed, and reports whether it did.
+// The files are checked without holding cacheMu, since that may mean reading
+// every one of them.
+func (c *cache) dropStale(module string) bool {
+	c.cacheMu.Lock()
+	e := c.cache[module]
+	if e == nil || !c.reload || !e.isReady() {
+		c.cacheMu.Unlock()
+		return false
+	}
+	var stamps []stamp
+	if e.err == nil {
+		stamps = c.depStampsLocked(module, map[string]bool{}, nil)
+	}
+	c.cacheMu.Unlock()
+
+	stale := e.err != nil
+	for _, s := range stamps {
+		if stale {
+			break
+		}
+		stale = s.changed()
+	}
+	if !stale {
+		return false
+	}
 	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	// some other goroutine may have dropped or reloaded it meanwhile.
+	if c.cache[module] != e {
+		return false
+	}
 	delete(c.cache, module)
+	delete(c.deps, module)
+	return true
+}
+
+func (c *cache) setLimits(limits Limits) {
+	c.cacheMu.Lock()
+	c.limits = limits
 	c.cacheMu.Unlock()
 }
 
+// stamps returns the stamps of the files of all loaded modules, and the names
+// of the modules that failed to load.
+func (c *cache) stamps() (stamps map[string]stamp, failed []string) {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	stamps = make(map[string]stamp, len(c.cache))
+	for module, e := range c.cache {
+		if !e.isReady() {
+			continue
+		}
+		if e.err != nil {
+			failed = append(failed, module)
+		} else {
+			stamps[module] = e.stamp
+		}
+	}
+	return stamps, failed
+}
+
 func (c *cache) reset() {
 	c.cacheMu.Lock()
 	c.cache = make(map[string]*entry)
+	c.deps = make(map[string]map[string]bool)
 	c.cacheMu.Unlock()
 }
 
 // get loads and returns an entry (if not already loaded).
-func (c *cache) get(cc *cycleChecker, module string) (starlark.StringDict, error) {
+func (c *cache) get(cc *cycleChecker, print func(*starlark.Thread, string), ctx context.Context, module string) (starlark.StringDict, error) {
+	if c.dropStale(module) && c.onReload != nil {
+		defer c.onReload(module)
+	}
 	c.cacheMu.Lock()
+	if globals, ok := c.modules[module]; ok {
+		c.cacheMu.Unlock()
+		c.observer.CacheLookup(ModuleCache, module, true)
+		return globals, nil
+	}
 	e := c.cache[module]
 	if e != nil {
 		c.cacheMu.Unlock()
+		c.observer.CacheLookup(ModuleCache, module, true)
 		// Some other goroutine is getting this module.
 		// Wait for it to become ready.
 
 		// Detect load cycles to avoid deadlocks.
 		if err := cycleCheck(e, cc); err != nil {
+			c.observer.LoadCycle(module)
 			return nil, err
 		}
 
 		cc.setWaitsFor(e)
-		<-e.ready
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			cc.setWaitsFor(nil)
+			return nil, ctx.Err()
+		}
 		cc.setWaitsFor(nil)
+		if e.cancelled {
+			// the goroutine loading the module gave up, but we haven't,
+			// so load it ourselves.
+			return c.get(cc, print, ctx, module)
+		}
 	} else {
 		// First request for this module.
 		e = &entry{ready: make(chan struct{})}
 		c.cache[module] = e
 		c.cacheMu.Unlock()
+		c.observer.CacheLookup(ModuleCache, module, false)
 
 		e.setOwner(cc)
-		e.globals, e.err = c.doLoad(cc, module)
+		e.globals, e.stamp, e.err = c.doLoad(cc, print, ctx, module)
 		e.setOwner(nil)
 
+		if e.err != nil && ctx.Err() != nil {
+			// the load was cut short by this caller's context, so don't
+			// keep the failure for other callers.
+			e.cancelled = true
+			c.cacheMu.Lock()
+			if c.cache[module] == e {
+				delete(c.cache, module)
+			}
+			c.cacheMu.Unlock()
+		}
+
 		// Broadcast that the entry is now ready.
 		close(e.ready)
 	}
 	return e.globals, e.err
 }
 
-func (c *cache) doLoad(cc *cycleChecker, module string) (starlark.StringDict, error) {
+func (c *cache) doLoad(cc *cycleChecker, print func(*starlark.Thread, string), ctx context.Context, module string) (starlark.StringDict, stamp, error) {
+	if print == nil {
+		print = c.print
+	}
+	if print == nil {
+		print = func(_ *starlark.Thread, msg string) { fmt.Println(msg) }
+	}
 	thread := &starlark.Thread{
-		Print: func(_ *starlark.Thread, msg string) { fmt.Println(msg) },
-		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+		Print: print,
+		Load: func(_ *starlark.Thread, dep string) (starlark.StringDict, error) {
+			dep, err := c.resolve(module, dep)
+			if err != nil {
+				return nil, err
+			}
+			c.addDep(module, dep)
 			// Tunnel the cycle-checker state for this "thread of loading".
-			return c.get(cc, module)
+			return c.get(cc, print, ctx, dep)
 		},
 	}
-	b, err := c.readFile(module)
+	thread.SetLocal(convert.ContextLocal, ctx)
+	if c.interceptor != nil {
+		thread.SetLocal(convert.InterceptorLocal, c.interceptor)
+	}
+	if c.policy != nil {
+		thread.SetLocal(convert.PolicyLocal, c.policy)
+	}
+	b, s, err := c.readFile(module)
+	if err != nil {
+		return nil, s, err
+	}
+	source := func(name string) []byte {
+		if name == module {
+			return b
+		}
+		b, _, _ := c.readFile(name)
+		return b
+	}
+	c.cacheMu.Lock()
+	cfg := config{ctx: ctx, limits: c.limits, source: source}
+	c.cacheMu.Unlock()
+	prog, err := c.compile(module, b, c.globals)
 	if err != nil {
-		return nil, err
+		return nil, s, scriptError(err, err, source)
 	}
-	return starlark.ExecFile(thread, module, b, c.globals)
+	globals, err := execThread(cfg, thread, func() (starlark.StringDict, error) {
+		return prog.Init(thread, c.globals)
+	})
+	// Like starlark.ExecFile, freeze the module so it can be shared safely.
+	globals.Freeze()
+	return globals, s, err
 }
 
 // -- concurrent cycle checking --
@@ -0,0 +1,280 @@
+package starlight
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Check compiles every script in the cache's sources without running it, and
+// returns all the problems it finds, rather than stopping at the first.  It
+// reports scripts that fail to parse or that use undefined names, load()
+// statements whose target doesn't exist, and cycles of scripts that load each
+// other.  Scripts may use the given predeclared names, which should be the
+// names of the globals passed to Run.  Scripts that other scripts load are
+// checked as modules instead: they may only use the module globals given to
+// the cache, since that's all they get when they're loaded.
+//
+// Only sources that implement ListSource, such as Dir and FS, are searched for
+// scripts, but scripts loaded from other sources are checked too.  Check
+// returns nil if it finds no problems.
+func (c *Cache) Check(predeclared ...string) []error {
+	names, errs := c.list()
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[name] = true
+	}
+	// find every script that's loaded before compiling anything, since
+	// scripts that are loaded get the module globals, and scripts that are
+	// run get the names given to Run.  Scripts that can't be read or parsed
+	// are reported when they're compiled.
+	graph := map[string][]string{}
+	loaded := map[string]bool{}
+	var loadErrs []error
+	queue := append([]string(nil), names...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		b, _, err := c.readFile(name)
+		if err != nil {
+			continue
+		}
+		f, err := c.cfg.dialect.Parse(name, b, 0)
+		if err != nil {
+			continue
+		}
+		for _, stmt := range f.Stmts {
+			load, ok := stmt.(*syntax.LoadStmt)
+			if !ok {
+				continue
+			}
+			module := load.Module.Value.(string)
+			dep, err := c.resolve(name, module)
+			if err == nil && !c.cache.registered(dep) {
+				_, _, err = c.readFile(dep)
+			}
+			if err != nil {
+				loadErrs = append(loadErrs, loadError(load.Module.TokenPos, module, err, b))
+				continue
+			}
+			if c.cache.registered(dep) {
+				continue
+			}
+			loaded[dep] = true
+			graph[name] = append(graph[name], dep)
+			if !seen[dep] {
+				seen[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	var run, modules []string
+	for name := range seen {
+		if loaded[name] {
+			modules = append(modules, name)
+		} else {
+			run = append(run, name)
+		}
+	}
+	sort.Strings(run)
+	sort.Strings(modules)
+	_, cerrs := c.compileAll(run, c.predeclared(predeclared))
+	errs = append(errs, cerrs...)
+	_, cerrs = c.compileAll(modules, c.cache.globals)
+	errs = append(errs, cerrs...)
+	errs = append(errs, loadErrs...)
+	errs = append(errs, cycles(graph)...)
+	return errs
+}
+
+// Preload compiles every script in the cache's sources, in parallel, so that
+// the first run of each script doesn't have to.  Predeclared is the same as
+// for Check, and as with Run, scripts can't use the module globals.  Like Check, it only finds scripts in sources that implement
+// ListSource.  It returns the errors from any scripts that failed to compile,
+// which are left to be compiled again when they're run.
+func (c *Cache) Preload(predeclared ...string) []error {
+	names, errs := c.list()
+	progs, cerrs := c.compileAll(names, c.predeclared(predeclared))
+	errs = append(errs, cerrs...)
+	c.mu.Lock()
+	for name, p := range progs {
+		c.scripts[name] = p.prog
+		c.stamps[name] = p.stamp
+	}
+	c.mu.Unlock()
+	return errs
+}
+
+// compiled is a compiled script, along with its source.
+type compiled struct {
+	src   []byte
+	stamp stamp
+	prog  *starlark.Program
+}
+
+// list returns the sorted canonical names of the scripts in the cache's
+// sources that can be listed.
+func (c *Cache) list() ([]string, []error) {
+	var errs []error
+	seen := map[string]bool{}
+	add := func(prefix string, sources []Source) {
+		for _, src := range sources {
+			ls, ok := src.(ListSource)
+			if !ok {
+				continue
+			}
+			names, err := ls.List()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot list scripts in %s: %v", sourceName(src), err))
+			}
+			for _, name := range names {
+				seen[prefix+name] = true
+			}
+		}
+	}
+	add("", c.sources)
+	for ns, sources := range c.namespaces {
+		add("@"+ns+"//", sources)
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, errs
+}
+
+// predeclared returns the given names of the globals passed to Run, which
+// scripts may use without defining them.  Only the names matter for
+// compiling.
+func (c *Cache) predeclared(names []string) starlark.StringDict {
+	dict := make(starlark.StringDict, len(names))
+	for _, name := range names {
+		dict[name] = starlark.None
+	}
+	return dict
+}
+
+// compileAll reads and compiles the scripts with the given canonical names in
+// parallel.  It returns the scripts that compiled, and the errors, sorted by
+// script name, for the ones that didn't.
+func (c *Cache) compileAll(names []string, predeclared starlark.StringDict) (map[string]*compiled, []error) {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		progs = make(map[string]*compiled, len(names))
+		errs  = make(map[string]error)
+		sem   = make(chan struct{}, runtime.GOMAXPROCS(0))
+	)
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			b, s, err := c.readFile(name)
+			var p *starlark.Program
+			if err == nil {
+				p, err = c.compile(name, b, predeclared)
+				err = scriptError(err, err, c.source)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			progs[name] = &compiled{src: b, stamp: s, prog: p}
+		}(name)
+	}
+	wg.Wait()
+	var list []error
+	for _, name := range names {
+		if err, ok := errs[name]; ok {
+			list = append(list, err)
+		}
+	}
+	return progs, list
+}
+
+// loadError returns the error for a load() statement at pos whose module
+// could not be found.
+func loadError(pos syntax.Position, module string, err error, src []byte) error {
+	msg := fmt.Sprintf("cannot load %s: %v", module, err)
+	return &ScriptError{
+		Filename: pos.Filename(),
+		Line:     int(pos.Line),
+		Col:      int(pos.Col),
+		Msg:      msg,
+		Snippet:  snippet(src, int(pos.Line), int(pos.Col)),
+		Err:      err,
+		text:     fmt.Sprintf("%s: %s", pos, msg),
+	}
+}
+
+// cycles returns an error for each distinct cycle in the load graph.
+func cycles(graph map[string][]string) []error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	seen := map[string]bool{}
+	var errs []error
+	var stack []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range graph[name] {
+			switch state[dep] {
+			case visiting:
+				// the cycle is the part of the stack from dep onwards.
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == dep {
+						cycle = append([]string(nil), stack[i:]...)
+						break
+					}
+				}
+				if key := cycleKey(cycle); !seen[key] {
+					seen[key] = true
+					errs = append(errs, fmt.Errorf("cycle in load graph: %s -> %s", strings.Join(cycle, " -> "), dep))
+				}
+			case 0:
+				visit(dep)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	names := make([]string, 0, len(graph))
+	for name := range graph {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+	return errs
+}
+
+// cycleKey returns the same key for every rotation of cycle.
+func cycleKey(cycle []string) string {
+	min := 0
+	for i := range cycle {
+		if cycle[i] < cycle[min] {
+			min = i
+		}
+	}
+	return strings.Join(append(append([]string(nil), cycle[min:]...), cycle[:min]...), "\x00")
+}
@@ -0,0 +1,126 @@
+package starlight
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// compile compiles the script with the given filename and source, resolving
+// names against the given predeclared globals.  If the cache was created with
+// WithCompileCache, compiled programs are read from and written to disk.
+func (c *Cache) compile(filename string, src []byte, predeclared starlark.StringDict) (*starlark.Program, error) {
+	start := time.Now()
+	p, err := c.compileProgram(filename, src, predeclared)
+	c.cfg.observer.Compiled(filename, time.Since(start), err)
+	return p, err
+}
+
+func (c *Cache) compileProgram(filename string, src []byte, predeclared starlark.StringDict) (*starlark.Program, error) {
+	dialect := &c.cfg.dialect
+	if c.cfg.compileDir == "" {
+		_, p, err := starlark.SourceProgramOptions(dialect, filename, src, predeclared.Has)
+		return p, err
+	}
+	path := filepath.Join(c.cfg.compileDir, compileKey(dialect, filename, src, predeclared)+".starc")
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if p, err := starlark.CompiledProgram(bytes.NewReader(b)); err == nil {
+			return p, nil
+		}
+		// corrupt, or written by a different version of starlark; recompile
+		// and overwrite it.
+	}
+	_, p, err := starlark.SourceProgramOptions(dialect, filename, src, predeclared.Has)
+	if err != nil {
+		return nil, err
+	}
+	// the disk cache is only an optimization, so failing to write it isn't
+	// an error.
+	_ = writeCompiled(path, p)
+	return p, nil
+}
+
+// compileKey returns the name the compiled form of the given script is stored
+// under.  Everything that affects compilation is part of the key, so changing
+// any of it results in a different file.
+func compileKey(dialect *syntax.FileOptions, filename string, src []byte, predeclared starlark.StringDict) string {
+	names := make([]string, 0, len(predeclared))
+	for name := range predeclared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	h.Write([]byte(starlarkVersion()))
+	h.Write([]byte{0})
+	fmt.Fprintf(h, "%+v", *dialect)
+	h.Write([]byte{0})
+	h.Write([]byte(filename))
+	h.Write([]byte{0})
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+	}
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeCompiled writes p to path, replacing any existing file atomically so
+// that concurrent readers never see a partial program.
+func writeCompiled(path string, p *starlark.Program) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".starc")
+	if err != nil {
+		return err
+	}
+	if err := p.Write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+var (
+	versionOnce sync.Once
+	version     string
+)
+
+// starlarkVersion returns the version of the starlark interpreter compiled
+// into this binary, or "unknown" if it can't be determined.
+func starlarkVersion() string {
+	versionOnce.Do(func() {
+		version = "unknown"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "go.starlark.net" {
+				version = dep.Version
+				if dep.Replace != nil {
+					version = dep.Replace.Path + "@" + dep.Replace.Version
+				}
+				return
+			}
+		}
+	})
+	return version
+}
@@ -0,0 +1,103 @@
+package convert
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+// callbackPanic is what a go func made by makeGoFunc panics with when fn fails
+// and the func has no error result to return.  callGo recovers it, so the
+// script sees the error.
+type callbackPanic struct {
+	err error
+}
+
+// makeGoFunc returns a go func of type t that calls the starlark callable fn
+// on thread, so that scripts can pass functions and lambdas to go functions
+// that take a func.  The func's arguments are converted to starlark values as
+// with ToValue, and fn's result is converted to the func's results as with
+// Decode; if the func has more than one result other than an error, fn must
+// return a tuple of them.  If fn fails, the func returns the error if its last
+// result is an error, and panics otherwise.
+//
+// Starlark threads can only run one call at a time, so the func must only be
+// called from the go function it was passed to, on the same goroutine, before
+// that function returns.
+func makeGoFunc(thread *starlark.Thread, fn starlark.Callable, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		out, err := callStarlark(thread, fn, t, in)
+		if err == nil {
+			return out
+		}
+		if t.NumOut() == 0 || t.Out(t.NumOut()-1) != errType {
+			panic(callbackPanic{err})
+		}
+		out = make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		out[len(out)-1] = reflect.ValueOf(&err).Elem()
+		return out
+	})
+}
+
+// callStarlark calls fn on thread with the go arguments in, and returns its
+// result converted to the results of the func type t, without the trailing
+// error, if t has one.
+func callStarlark(thread *starlark.Thread, fn starlark.Callable, t reflect.Type, in []reflect.Value) ([]reflect.Value, error) {
+	if t.IsVariadic() {
+		variadic := in[len(in)-1]
+		in = in[:len(in)-1]
+		for i := 0; i < variadic.Len(); i++ {
+			in = append(in, variadic.Index(i))
+		}
+	}
+	p, _ := thread.Local(PolicyLocal).(*Policy)
+	args := make(starlark.Tuple, len(in))
+	for i, v := range in {
+		arg, err := toValue(v)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			restrict(arg, p)
+		}
+		args[i] = arg
+	}
+	ret, err := starlark.Call(thread, fn, args, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	n := t.NumOut()
+	hasErr := n > 0 && t.Out(n-1) == errType
+	if hasErr {
+		n--
+	}
+	var rets []starlark.Value
+	switch {
+	case n == 0:
+	case n == 1:
+		rets = []starlark.Value{ret}
+	default:
+		tuple, ok := ret.(starlark.Tuple)
+		if !ok || len(tuple) != n {
+			return nil, fmt.Errorf("%s: expected a tuple of %d values, but got %s", fn.Name(), n, ret.Type())
+		}
+		rets = tuple
+	}
+	out := make([]reflect.Value, 0, t.NumOut())
+	for i, v := range rets {
+		dst := reflect.New(t.Out(i)).Elem()
+		if err := decode(thread, v, dst, fn.Name()+" result"); err != nil {
+			return nil, err
+		}
+		out = append(out, dst)
+	}
+	if hasErr {
+		out = append(out, reflect.Zero(errType))
+	}
+	return out, nil
+}
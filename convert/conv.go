@@ -1,22 +1,16 @@
 package convert
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 
-	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
 )
 
-func init() {
-	resolve.AllowNestedDef = true // allow def statements within function bodies
-	resolve.AllowLambda = true    // allow lambda expressions
-	resolve.AllowFloat = true     // allow floating point literals, the 'float' built-in, and x / y
-	resolve.AllowSet = true       // allow the 'set' built-in
-	resolve.AllowBitwise = true   // allow bitwise operands
-}
-
 // ToValue attempts to convert the given value to a starlark.Value.  It supports
 // all int, uint, and float numeric types, plus strings and bools.  It supports
 // structs, maps, slices, and functions that use the aforementioned.  Any
@@ -28,6 +22,21 @@ func ToValue(v interface{}) (starlark.Value, error) {
 	return toValue(reflect.ValueOf(v))
 }
 
+// ReadOnly converts v as with ToValue, and freezes the result, so that scripts
+// can read v but not change it.  Fields and elements read from the result are
+// frozen too.  Methods with pointer receivers can't be called on the result,
+// even ones that only read the value, such as getters, unless a Policy given
+// with Restricted or WithPolicy marks them with Policy.Read.  ReadOnly panics
+// if v can't be converted.
+func ReadOnly(v interface{}) starlark.Value {
+	val, err := ToValue(v)
+	if err != nil {
+		panic(err)
+	}
+	val.Freeze()
+	return val
+}
+
 func hasMethods(val reflect.Value) bool {
 	if val.NumMethod() > 0 {
 		return true
@@ -39,6 +48,13 @@ func hasMethods(val reflect.Value) bool {
 }
 
 func toValue(val reflect.Value) (starlark.Value, error) {
+	if val.IsValid() && val.CanInterface() {
+		// values that are already starlark values, e.g. returned from a
+		// function, are passed through as-is.
+		if v, ok := val.Interface().(starlark.Value); ok {
+			return v, nil
+		}
+	}
 	if hasMethods(val) {
 		// this handles all basic types with methods (numbers, strings, bools)
 		ifc, ok := makeGoInterface(val)
@@ -62,7 +78,7 @@ func toValue(val reflect.Value) (starlark.Value, error) {
 	case reflect.Float32, reflect.Float64:
 		return starlark.Float(val.Float()), nil
 	case reflect.Func:
-		return makeStarFn("fn", val), nil
+		return makeStarFn("fn", reflect.Value{}, val), nil
 	case reflect.Map:
 		return &GoMap{v: val}, nil
 	case reflect.String:
@@ -78,6 +94,51 @@ func toValue(val reflect.Value) (starlark.Value, error) {
 	return nil, fmt.Errorf("type %T is not a supported starlark type", val.Interface())
 }
 
+// toChild converts a value reached through parent, which is a struct or
+// collection, and passes on parent's settings to it.
+func toChild(val reflect.Value, parent starlark.Value) (starlark.Value, error) {
+	v, err := toValue(val)
+	if err != nil {
+		return nil, err
+	}
+	inherit(v, parent)
+	return v, nil
+}
+
+// inherit passes on the settings of parent to child, a value read through it.
+// If the parent is frozen, so is the child, which makes freezing transitive
+// even though child values are wrapped afresh each time they're read.
+// Likewise, the child holds the parent's mutex and follows its policy, if it
+// has them.
+func inherit(child, parent starlark.Value) {
+	frozen, mu, policy := shared(parent)
+	if frozen {
+		child.Freeze()
+	}
+	if mu != nil {
+		setMutex(child, mu)
+	}
+	if policy != nil {
+		setPolicy(child, policy)
+	}
+}
+
+// shared returns the settings of v, if it wraps a go value, that the values
+// read through it share.
+func shared(v starlark.Value) (frozen bool, mu *sync.RWMutex, policy *Policy) {
+	switch v := v.(type) {
+	case *GoStruct:
+		return v.frozen, v.mu, v.policy
+	case *GoInterface:
+		return v.frozen, v.mu, v.policy
+	case *GoMap:
+		return v.frozen, v.mu, v.policy
+	case *GoSlice:
+		return v.frozen, v.mu, v.policy
+	}
+	return false, nil, nil
+}
+
 // FromValue converts a starlark value to a go value.
 func FromValue(v starlark.Value) interface{} {
 	switch v := v.(type) {
@@ -126,6 +187,17 @@ func FromValue(v starlark.Value) interface{} {
 func MakeStringDict(m map[string]interface{}) (starlark.StringDict, error) {
 	dict := make(starlark.StringDict, len(m))
 	for k, v := range m {
+		// name functions after their global, for errors and interceptors.
+		if f, ok := v.(*Function); ok {
+			dict[k] = f.named(k)
+			continue
+		}
+		if _, ok := v.(starlark.Value); !ok {
+			if rv := reflect.ValueOf(v); rv.Kind() == reflect.Func {
+				dict[k] = makeStarFn(k, reflect.Value{}, rv)
+				continue
+			}
+		}
 		val, err := ToValue(v)
 		if err != nil {
 			return nil, err
@@ -154,6 +226,20 @@ func FromTuple(v starlark.Tuple) []interface{} {
 	return ret
 }
 
+// MakeTuple makes a tuple from the given values.  The acceptable values are the
+// same as ToValue.
+func MakeTuple(v []interface{}) (starlark.Tuple, error) {
+	vals := make([]starlark.Value, 0, len(v))
+	for i := range v {
+		val, err := ToValue(v[i])
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	return starlark.Tuple(vals), nil
+}
+
 // FromList creates a go slice from the given starlark list.
 func FromList(l *starlark.List) []interface{} {
 	ret := make([]interface{}, 0, l.Len())
@@ -259,7 +345,62 @@ func FromKwargs(kwargs []starlark.Tuple) ([]Kwarg, error) {
 	return args, nil
 }
 
-var errType = reflect.TypeOf((*error)(nil)).Elem()
+// MakeKwargs converts the given map into a python style name=val, name2=val2
+// list of tuples, sorted by name.  The acceptable values are the same as
+// ToValue.
+func MakeKwargs(m map[string]interface{}) ([]starlark.Tuple, error) {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	kwargs := make([]starlark.Tuple, 0, len(m))
+	for _, k := range names {
+		val, err := ToValue(m[k])
+		if err != nil {
+			return nil, err
+		}
+		kwargs = append(kwargs, starlark.Tuple{starlark.String(k), val})
+	}
+	return kwargs, nil
+}
+
+var (
+	errType     = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	threadType  = reflect.TypeOf((*starlark.Thread)(nil))
+)
+
+// ContextLocal is the name of the thread-local value that holds the
+// context.Context passed to go functions that take one.  See MakeStarFn.
+const ContextLocal = "github.com/starlight-go/starlight.context"
+
+// Context returns the context.Context stored in the thread's ContextLocal
+// value, or context.Background() if there isn't one.
+func Context(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local(ContextLocal).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// injected returns the number of leading parameters of a go function that are
+// filled from the starlark thread rather than from the script's arguments.
+func injected(t reflect.Type) int {
+	if t.NumIn() > 0 && (t.In(0) == contextType || t.In(0) == threadType) {
+		return 1
+	}
+	return 0
+}
+
+// injectArg returns the value of a go function's first parameter of type t,
+// filled from the thread.
+func injectArg(thread *starlark.Thread, t reflect.Type) reflect.Value {
+	if t == threadType {
+		return reflect.ValueOf(thread)
+	}
+	return reflect.ValueOf(Context(thread))
+}
 
 // MakeStarFn creates a wrapper around the given function that can be called from
 // a starlark script.  Argument support is the same as ToValue. If the last value
@@ -267,39 +408,151 @@ var errType = reflect.TypeOf((*error)(nil)).Elem()
 // the starlark function.  If there are no other errors, the function will return
 // None.  If there's exactly one other value, the function will return the
 // starlark equivalent of that value.  If there is more than one return value,
-// they'll be returned as a tuple.  MakeStarFn will panic if you pass it
-// something other than a function.
+// they'll be returned as a tuple.  If the function's first parameter is a
+// context.Context or a *starlark.Thread, it isn't filled from the script's
+// arguments; it gets the context from Context(thread) or the calling thread
+// itself.
+//
+// Scripts may only pass keyword arguments if the function's last parameter is
+// a struct or a pointer to a struct and they leave it out of the positional
+// arguments.  Then it's filled from the keyword arguments: each one sets the
+// exported field with the same name, or the name given in a
+// `starlark:"name"` struct tag.  Keyword arguments that match no field are an
+// error, as is leaving out a field tagged `starlark:"name,required"`.  Leaving
+// out the struct without passing any keyword arguments is an error too, so
+// functions that take a struct don't run with a zero value by accident.
+//
+// MakeStarFn will panic if you pass it something other than a function.
 func MakeStarFn(name string, gofn interface{}) *starlark.Builtin {
 	v := reflect.ValueOf(gofn)
 	if v.Kind() != reflect.Func {
 		panic(errors.New("fn is not a function"))
 	}
-	return makeStarFn(name, v)
+	return makeStarFn(name, reflect.Value{}, v)
 }
 
-func makeStarFn(name string, gofn reflect.Value) *starlark.Builtin {
+// makeStarFn wraps gofn, which is a method of recv if recv is valid.
+func makeStarFn(name string, recv, gofn reflect.Value) *starlark.Builtin {
 	if gofn.Type().IsVariadic() {
-		return makeVariadicStarFn(name, gofn)
+		return makeVariadicStarFn(name, recv, gofn)
 	}
+	skip := injected(gofn.Type())
+	options := optionsParam(gofn.Type(), skip)
 	return starlark.NewBuiltin(name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		if len(args) != gofn.Type().NumIn() {
-			return starlark.None, fmt.Errorf("expected %d args but got %d", gofn.Type().NumIn(), len(args))
-		}
-		vals := FromTuple(args)
-		rvs := make([]reflect.Value, 0, len(vals))
-		for i, v := range vals {
-			val := reflect.ValueOf(v)
-			argT := gofn.Type().In(i)
-			if !val.Type().AssignableTo(argT) {
-				val = val.Convert(argT)
+		numIn := gofn.Type().NumIn()
+		// the options struct is filled from kwargs if the script passes
+		// them instead of the struct.
+		fromKw := options && len(kwargs) > 0 && len(args) == numIn-skip-1
+		if len(args) != numIn-skip && !fromKw {
+			return starlark.None, fmt.Errorf("expected %d args but got %d", numIn-skip, len(args))
+		}
+		if len(kwargs) > 0 && !fromKw {
+			return starlark.None, fmt.Errorf("%s: unexpected keyword argument %s", name, kwargs[0][0].(starlark.String).GoString())
+		}
+		rvs := make([]reflect.Value, 0, numIn)
+		if skip > 0 {
+			rvs = append(rvs, injectArg(thread, gofn.Type().In(0)))
+		}
+		for i, v := range args {
+			arg, err := convertArg(thread, name, i, v, gofn.Type().In(i+skip))
+			if err != nil {
+				return starlark.None, err
+			}
+			rvs = append(rvs, arg)
+		}
+		if fromKw {
+			opts, err := fromKwargs(thread, name, kwargs, gofn.Type().In(numIn-1))
+			if err != nil {
+				return starlark.None, err
 			}
-			rvs = append(rvs, val)
+			rvs = append(rvs, opts)
 		}
-		out := gofn.Call(rvs)
-		return makeOut(out)
+		return callGo(thread, name, recv, gofn, skip, rvs)
 	})
 }
 
+// methodValue returns the starlark function for the method with the given
+// name of recv, which parent wraps.  Methods with pointer receivers may mutate
+// recv, so if parent is frozen they fail when called, and if parent has a
+// mutex they hold its write lock.  Other methods hold the read lock.  Since the
+// lock isn't reentrant, scripts can't pass functions to the methods of a value
+// with a mutex, which could use the value while the lock is held.  The values
+// methods return inherit parent's settings.  Kind describes recv in error
+// messages.
+func methodValue(parent starlark.Value, recv reflect.Value, name string, method reflect.Value, kind string) (starlark.Value, error) {
+	fn := makeStarFn(name, recv, method)
+	frozen, mu, policy := shared(parent)
+	if !frozen && mu == nil && policy == nil {
+		return fn, nil
+	}
+	mutates := false
+	if recv.Kind() == reflect.Ptr {
+		_, ok := recv.Elem().Type().MethodByName(name)
+		mutates = !ok && !policy.reads(recv.Type(), name)
+	}
+	if frozen && mutates {
+		return starlark.NewBuiltin(name, func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			return nil, fmt.Errorf("cannot call %s on frozen %s: it may modify the %s", name, kind, kind)
+		}), nil
+	}
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if mu != nil && passesCallable(args, kwargs) {
+			return nil, fmt.Errorf("cannot pass a function to %s of synchronized %s: it would run with the %s locked", name, kind, kind)
+		}
+		locker := rlock
+		if mutates {
+			locker = lock
+		}
+		v, err := func() (starlark.Value, error) {
+			defer locker(mu)()
+			return fn.CallInternal(thread, args, kwargs)
+		}()
+		if v != nil {
+			inherit(v, parent)
+		}
+		return v, err
+	}), nil
+}
+
+// passesCallable reports whether any of args or kwargs is a function.
+func passesCallable(args starlark.Tuple, kwargs []starlark.Tuple) bool {
+	for _, v := range args {
+		if _, ok := v.(starlark.Callable); ok {
+			return true
+		}
+	}
+	for _, kv := range kwargs {
+		if _, ok := kv[1].(starlark.Callable); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// convertArg converts the starlark argument with the given index to argT, the
+// type of a go function's parameter.  Parameters that accept starlark values,
+// such as starlark.Value itself, receive the argument as-is, and parameters
+// that accept the go equivalent of the argument from FromValue receive that.
+// Everything else is converted as with Decode, so that arguments of the wrong
+// type are an error, rather than a panic, since scripts may be untrusted.
+// Func parameters given a starlark callable receive a func that calls it on
+// thread.  Fnname is the name of the function, for error messages.
+func convertArg(thread *starlark.Thread, fnname string, i int, v starlark.Value, argT reflect.Type) (reflect.Value, error) {
+	if argT.Kind() != reflect.Interface || argT.NumMethod() > 0 {
+		if val := reflect.ValueOf(v); val.Type().AssignableTo(argT) {
+			return val, nil
+		}
+	}
+	if val := reflect.ValueOf(FromValue(v)); val.IsValid() && val.Type().AssignableTo(argT) {
+		return val, nil
+	}
+	dst := reflect.New(argT).Elem()
+	if err := decode(thread, v, dst, fmt.Sprintf("argument %d", i+1)); err != nil {
+		return reflect.Value{}, fmt.Errorf("%s: %v", fnname, err)
+	}
+	return dst, nil
+}
+
 func makeOut(out []reflect.Value) (starlark.Value, error) {
 	if len(out) == 0 {
 		return starlark.None, nil
@@ -312,6 +565,9 @@ func makeOut(out []reflect.Value) (starlark.Value, error) {
 		}
 		out = out[:len(out)-1]
 	}
+	if len(out) == 0 {
+		return starlark.None, err
+	}
 	if len(out) == 1 {
 		v, err2 := toValue(out[0])
 		if err2 != nil {
@@ -328,39 +584,43 @@ func makeOut(out []reflect.Value) (starlark.Value, error) {
 		}
 		res = append(res, val)
 	}
-	return starlark.Tuple(res), nil
+	return starlark.Tuple(res), err
 }
 
-func makeVariadicStarFn(name string, gofn reflect.Value) *starlark.Builtin {
+func makeVariadicStarFn(name string, recv, gofn reflect.Value) *starlark.Builtin {
+	skip := injected(gofn.Type())
 	return starlark.NewBuiltin(name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		minArgs := gofn.Type().NumIn() - 1
+		minArgs := gofn.Type().NumIn() - 1 - skip
 		if len(args) < minArgs {
 			return starlark.None, fmt.Errorf("expected at least %d args but got %d", minArgs, len(args))
 		}
-		vals := FromTuple(args)
-		rvs := make([]reflect.Value, 0, len(args))
+		if len(kwargs) > 0 {
+			return starlark.None, fmt.Errorf("%s: unexpected keyword argument %s", name, kwargs[0][0].(starlark.String).GoString())
+		}
+		rvs := make([]reflect.Value, 0, len(args)+skip)
+		if skip > 0 {
+			rvs = append(rvs, injectArg(thread, gofn.Type().In(0)))
+		}
 
 		// grab all the non-variadics first
 		for i := 0; i < minArgs; i++ {
-			val := reflect.ValueOf(vals[i])
-			argT := gofn.Type().In(i)
-			if !val.Type().AssignableTo(argT) {
-				val = val.Convert(argT)
+			arg, err := convertArg(thread, name, i, args[i], gofn.Type().In(i+skip))
+			if err != nil {
+				return starlark.None, err
 			}
-			rvs = append(rvs, val)
+			rvs = append(rvs, arg)
 		}
 		// last "in" type by definition must be a slice of something. We need to
 		// know what something so we can convert things as needed.
 		vtype := gofn.Type().In(gofn.Type().NumIn() - 1).Elem()
 		// the rest of the args need to be batched into a slice for the variadic
-		for i := minArgs; i < len(vals); i++ {
-			val := reflect.ValueOf(vals[i])
-			if !val.Type().AssignableTo(vtype) {
-				val = val.Convert(vtype)
+		for i := minArgs; i < len(args); i++ {
+			arg, err := convertArg(thread, name, i, args[i], vtype)
+			if err != nil {
+				return starlark.None, err
 			}
-			rvs = append(rvs, val)
+			rvs = append(rvs, arg)
 		}
-		out := gofn.Call(rvs)
-		return makeOut(out)
+		return callGo(thread, name, recv, gofn, skip, rvs)
 	})
 }
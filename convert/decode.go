@@ -0,0 +1,362 @@
+package convert
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// DecodeStringDict fills the fields of the struct that out points to from the
+// values in m.  Each exported field is filled from the value with the same
+// name as the field, or the name given in a `starlark:"name"` struct tag.
+// Fields tagged `starlark:"-"` and fields with no matching value are left
+// alone.  Values are converted as described for Decode.
+func DecodeStringDict(m starlark.StringDict, out interface{}) error {
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() || ptr.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("can only decode into a pointer to a struct, not %T", out)
+	}
+	strct := ptr.Elem()
+	t := strct.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		v, ok := m[name]
+		if !ok {
+			continue
+		}
+		if err := decode(nil, v, strct.Field(i), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode converts the starlark value v and stores it in the value that out
+// points to.  Lists, tuples and sets are decoded into slices and arrays, dicts
+// are decoded into maps and structs, and numbers are converted to the width of
+// the destination, so long as they fit.  Values wrapped by this package, such
+// as GoStruct, are stored as-is if their type matches.  Starlark functions
+// can't be decoded, since they'd be called outside the script; they can only
+// be passed to go functions the script calls.
+func Decode(v starlark.Value, out interface{}) error {
+	ptr := reflect.ValueOf(out)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("can only decode into a non-nil pointer, not %T", out)
+	}
+	return decode(nil, v, ptr.Elem(), "value")
+}
+
+// fieldName returns the name of the starlark value that should fill the
+// given struct field, and whether the field should be filled at all.
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		// unexported
+		return "", false
+	}
+	tag := f.Tag.Get("starlark")
+	if tag == "-" {
+		return "", false
+	}
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag != "" {
+		return tag, true
+	}
+	return f.Name, true
+}
+
+// fieldRequired reports whether the given struct field's tag has the required
+// option, as in `starlark:"name,required"`.
+func fieldRequired(f reflect.StructField) bool {
+	opts := strings.Split(f.Tag.Get("starlark"), ",")
+	for _, opt := range opts[1:] {
+		if opt == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+// decode stores v in dst, which must be settable.  The path describes where
+// dst lives, for error messages.  Starlark callables stored in funcs are
+// called on thread; see makeGoFunc.  If thread is nil, callables can't be
+// decoded.
+func decode(thread *starlark.Thread, v starlark.Value, dst reflect.Value, path string) error {
+	t := dst.Type()
+
+	// values we wrapped may already be the right type.
+	if rv, ok := goValue(v); ok {
+		if rv.Type().AssignableTo(t) {
+			dst.Set(rv)
+			return nil
+		}
+		if rv.Type().ConvertibleTo(t) && rv.Kind() == t.Kind() {
+			dst.Set(rv.Convert(t))
+			return nil
+		}
+		if rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Type().AssignableTo(t) {
+			dst.Set(rv.Elem())
+			return nil
+		}
+	}
+	// the destination may want the starlark value itself, e.g. a field of
+	// type starlark.Value or *starlark.List.
+	if t.Kind() != reflect.Interface || t.NumMethod() > 0 {
+		if rv := reflect.ValueOf(v); rv.Type().AssignableTo(t) {
+			dst.Set(rv)
+			return nil
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if v == starlark.None {
+			dst.Set(reflect.Zero(t))
+			return nil
+		}
+		val := reflect.ValueOf(FromValue(v))
+		if !val.Type().AssignableTo(t) {
+			return decodeErr(v, t, path)
+		}
+		dst.Set(val)
+		return nil
+	case reflect.Ptr:
+		if v == starlark.None {
+			dst.Set(reflect.Zero(t))
+			return nil
+		}
+		elem := reflect.New(t.Elem())
+		if err := decode(thread, v, elem.Elem(), path); err != nil {
+			return err
+		}
+		dst.Set(elem)
+		return nil
+	case reflect.Bool:
+		b, ok := v.(starlark.Bool)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		dst.SetBool(bool(b))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(starlark.Int)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		i, ok := n.Int64()
+		if !ok || dst.OverflowInt(i) {
+			return fmt.Errorf("cannot decode %s: %s overflows %s", path, n, t)
+		}
+		dst.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := v.(starlark.Int)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		u, ok := n.Uint64()
+		if !ok || dst.OverflowUint(u) {
+			return fmt.Errorf("cannot decode %s: %s overflows %s", path, n, t)
+		}
+		dst.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, ok := starlark.AsFloat(v)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		if dst.OverflowFloat(f) {
+			return fmt.Errorf("cannot decode %s: %v overflows %s", path, f, t)
+		}
+		dst.SetFloat(f)
+		return nil
+	case reflect.String:
+		s, ok := starlark.AsString(v)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		dst.SetString(s)
+		return nil
+	case reflect.Slice:
+		if v == starlark.None {
+			dst.Set(reflect.Zero(t))
+			return nil
+		}
+		if s, ok := v.(starlark.String); ok && t.Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+		vals, ok := elements(v)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		slice := reflect.MakeSlice(t, len(vals), len(vals))
+		for i, elem := range vals {
+			if err := decode(thread, elem, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+		return nil
+	case reflect.Array:
+		vals, ok := elements(v)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		if len(vals) != t.Len() {
+			return fmt.Errorf("cannot decode %s: %s has %d elements, but %s has %d", path, v.Type(), len(vals), t, t.Len())
+		}
+		for i, elem := range vals {
+			if err := decode(thread, elem, dst.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if v == starlark.None {
+			dst.Set(reflect.Zero(t))
+			return nil
+		}
+		items, ok := v.(starlark.IterableMapping)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		m := reflect.MakeMap(t)
+		for _, item := range items.Items() {
+			key := reflect.New(t.Key()).Elem()
+			if err := decode(thread, item[0], key, path+" key"); err != nil {
+				return err
+			}
+			val := reflect.New(t.Elem()).Elem()
+			if err := decode(thread, item[1], val, fmt.Sprintf("%s[%s]", path, item[0])); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, val)
+		}
+		dst.Set(m)
+		return nil
+	case reflect.Struct:
+		return decodeStruct(thread, v, dst, path)
+	case reflect.Func:
+		if v == starlark.None {
+			dst.Set(reflect.Zero(t))
+			return nil
+		}
+		fn, ok := v.(starlark.Callable)
+		if !ok {
+			return decodeErr(v, t, path)
+		}
+		if thread == nil {
+			// a func called after the script finishes would run without
+			// the script's limits, context, print function or policy.
+			return fmt.Errorf("cannot decode %s: functions can only be passed to go functions the script calls", path)
+		}
+		dst.Set(makeGoFunc(thread, fn, t))
+		return nil
+	}
+	return decodeErr(v, t, path)
+}
+
+// decodeStruct fills the fields of dst from the keys of a starlark dict, or
+// from the attributes of a starlark value with attributes.
+func decodeStruct(thread *starlark.Thread, v starlark.Value, dst reflect.Value, path string) error {
+	var get func(name string) (starlark.Value, bool, error)
+	switch v := v.(type) {
+	case starlark.Mapping:
+		get = func(name string) (starlark.Value, bool, error) {
+			return v.Get(starlark.String(name))
+		}
+	case starlark.HasAttrs:
+		get = func(name string) (starlark.Value, bool, error) {
+			val, err := v.Attr(name)
+			return val, val != nil, err
+		}
+	default:
+		return decodeErr(v, dst.Type(), path)
+	}
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := fieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+		val, found, err := get(name)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s.%s: %v", path, name, err)
+		}
+		if !found {
+			continue
+		}
+		if err := decode(thread, val, dst.Field(i), path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goValue returns the go value underlying v, if v wraps one.
+func goValue(v starlark.Value) (reflect.Value, bool) {
+	switch v := v.(type) {
+	case *GoStruct:
+		return v.v, true
+	case *GoInterface:
+		return v.v, true
+	case *GoMap:
+		return v.v, true
+	case *GoSlice:
+		return v.v, true
+	}
+	return reflect.Value{}, false
+}
+
+// elements returns the values in a starlark sequence or set.
+func elements(v starlark.Value) ([]starlark.Value, bool) {
+	if _, ok := v.(starlark.String); ok {
+		// strings are iterable in some dialects, but aren't lists.
+		return nil, false
+	}
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, false
+	}
+	var vals []starlark.Value
+	it := iterable.Iterate()
+	defer it.Done()
+	var elem starlark.Value
+	for it.Next(&elem) {
+		vals = append(vals, elem)
+	}
+	return vals, true
+}
+
+func decodeErr(v starlark.Value, t reflect.Type, path string) error {
+	return fmt.Errorf("cannot decode %s: expected %s, but got starlark %s", path, typeName(t), v.Type())
+}
+
+// typeName describes the go type t in terms of its starlark equivalent, where
+// there is one.
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return "int (" + t.String() + ")"
+	case reflect.Float32, reflect.Float64:
+		return "float (" + t.String() + ")"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "list (" + t.String() + ")"
+	case reflect.Map:
+		return "dict (" + t.String() + ")"
+	}
+	return strings.TrimPrefix(t.String(), "*")
+}
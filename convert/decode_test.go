@@ -0,0 +1,114 @@
+package convert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+type decodeItem struct {
+	Name  string
+	Count uint8
+}
+
+type decodeOut struct {
+	Name    string
+	Age     int32
+	Score   float32 `starlark:"score"`
+	Tags    []string
+	Counts  map[string]int
+	Items   []decodeItem
+	Pair    [2]int64
+	Maybe   *int
+	Any     interface{}
+	Filter  func(int) bool
+	Ignored string `starlark:"-"`
+	secret  string
+}
+
+func TestDecodeStringDict(t *testing.T) {
+	data := []byte(`
+Name = "bob"
+Age = 42
+score = 7
+Tags = ["a", "b"]
+Counts = {"x": 1, "y": 2}
+Items = [{"Name": "widget", "Count": 3}]
+Pair = (1, 2)
+Maybe = None
+Any = "anything"
+Ignored = "nope"
+`)
+	globals, err := starlark.ExecFile(&starlark.Thread{}, "foo.star", data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out decodeOut
+	if err := DecodeStringDict(globals, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeOut{
+		Name:   "bob",
+		Age:    42,
+		Score:  7,
+		Tags:   []string{"a", "b"},
+		Counts: map[string]int{"x": 1, "y": 2},
+		Items:  []decodeItem{{Name: "widget", Count: 3}},
+		Pair:   [2]int64{1, 2},
+		Any:    "anything",
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("expected %#v\nbut got %#v", expected, out)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{`Age = "old"`, `cannot decode Age: expected int (int32), but got starlark string`},
+		{`Tags = ["a", 1]`, `cannot decode Tags[1]: expected string, but got starlark int`},
+		{`Items = [{"Count": 300}]`, `cannot decode Items[0].Count: 300 overflows uint8`},
+		{`Pair = [1]`, `cannot decode Pair: list has 1 elements, but [2]int64 has 2`},
+		{`Filter = lambda x: x > 1`, `cannot decode Filter: functions can only be passed to go functions the script calls`},
+	}
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			globals, err := starlark.ExecFile(&starlark.Thread{}, "foo.star", test.code, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out decodeOut
+			err = DecodeStringDict(globals, &out)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestDecodeGoValue(t *testing.T) {
+	type thing struct{ Name string }
+	in := &thing{Name: "bob"}
+	v, err := ToValue(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ptr *thing
+	if err := Decode(v, &ptr); err != nil {
+		t.Fatal(err)
+	}
+	if ptr != in {
+		t.Fatalf("expected the same pointer back, but got %#v", ptr)
+	}
+	var val thing
+	if err := Decode(v, &val); err != nil {
+		t.Fatal(err)
+	}
+	if val != *in {
+		t.Fatalf("expected %#v, but got %#v", *in, val)
+	}
+}
@@ -434,3 +434,30 @@ out = vals[1:-1]
 		t.Fatalf("expected %#v but got %#v", expected, out)
 	}
 }
+
+func TestStarlarkValueArgs(t *testing.T) {
+	globals := map[string]interface{}{
+		"keys": func(d *starlark.Dict) starlark.Value {
+			return d.Keys()[0]
+		},
+		"fail": func() error {
+			return fmt.Errorf("failed")
+		},
+		"pair": func() (int, string, error) {
+			return 1, "a", fmt.Errorf("pair failed")
+		},
+	}
+	out, err := starlight.Eval([]byte(`x = keys({"a": 1})`), globals, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out["x"] != "a" {
+		t.Fatalf(`expected "a", got %v`, out["x"])
+	}
+	for _, code := range []string{"fail()", "pair()"} {
+		_, err := starlight.Eval([]byte(code), globals, nil)
+		if err == nil {
+			t.Errorf("%s: expected the go function's error", code)
+		}
+	}
+}
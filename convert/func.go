@@ -0,0 +1,330 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// Function wraps a go function so that scripts can call it like a starlark
+// builtin, passing arguments by position or by name, and leaving out optional
+// ones.  Make one with Func, and describe its parameters with Params:
+//
+//	convert.Func(fetch).Params("url", "timeout=30", "*headers").Doc("Fetch gets a URL.")
+//
+// Scripts can read a Function's signature and documentation from its
+// signature and doc attributes.  Arguments are converted to the types of the
+// go function's parameters as with Decode.  Results, and the context.Context
+// and *starlark.Thread parameters, are handled as with MakeStarFn.
+type Function struct {
+	name   string
+	fn     reflect.Value
+	skip   int
+	params []param
+	doc    string
+}
+
+type paramKind int
+
+const (
+	required paramKind = iota
+	optional
+	varArgs
+	varKwargs
+)
+
+// param describes one parameter of a Function.
+type param struct {
+	spec string // as passed to Params
+	name string
+	kind paramKind
+	// def is the default value of an optional parameter, or nil if it
+	// defaults to the zero value of its type.
+	def starlark.Value
+}
+
+var _ starlark.Callable = (*Function)(nil)
+var _ starlark.HasAttrs = (*Function)(nil)
+
+// Func returns a Function that calls fn.  Until Params is called, scripts must
+// pass every parameter, in order, and they are named arg1, arg2 and so on.  A
+// variadic function's last parameter is named *args.  Func panics if fn isn't
+// a function.
+func Func(fn interface{}) *Function {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		panic(errors.New("fn is not a function"))
+	}
+	f := &Function{name: "fn", fn: v, skip: injected(v.Type())}
+	n := v.Type().NumIn() - f.skip
+	specs := make([]string, n)
+	for i := range specs {
+		specs[i] = fmt.Sprintf("arg%d", i+1)
+	}
+	if v.Type().IsVariadic() {
+		specs[n-1] = "*args"
+	}
+	return f.Params(specs...)
+}
+
+// Params names the go function's parameters, in order, leaving out a leading
+// context.Context or *starlark.Thread, and returns f.  Each spec is one of:
+//
+//	name        a required parameter
+//	name?       an optional parameter, which defaults to its type's zero value
+//	name=expr   an optional parameter, which defaults to the value of the
+//	            starlark expression expr, such as 30 or "GET"
+//	*name       a slice that collects extra positional arguments
+//	**name      a map with string keys that collects extra keyword arguments
+//
+// As in starlark, required parameters can't follow optional ones, parameters
+// after *name can only be passed by name, and **name must come last.  Params
+// panics if the specs don't fit the function.
+func (f *Function) Params(specs ...string) *Function {
+	t := f.fn.Type()
+	if len(specs) != t.NumIn()-f.skip {
+		panic(fmt.Errorf("Params: function has %d parameters, but %d were given", t.NumIn()-f.skip, len(specs)))
+	}
+	params := make([]param, len(specs))
+	seen := map[string]bool{}
+	sawOptional, sawArgs := false, false
+	for i, spec := range specs {
+		p, err := parseParam(spec)
+		if err != nil {
+			panic(fmt.Errorf("Params: %v", err))
+		}
+		pt := t.In(i + f.skip)
+		switch {
+		case seen[p.name]:
+			err = fmt.Errorf("duplicate parameter %s", p.name)
+		case p.kind == required && sawOptional && !sawArgs:
+			err = fmt.Errorf("required parameter %s follows an optional one", p.name)
+		case p.kind == varArgs && sawArgs:
+			err = fmt.Errorf("more than one *parameter")
+		case p.kind == varArgs && pt.Kind() != reflect.Slice:
+			err = fmt.Errorf("%s must be a slice, not %s", spec, pt)
+		case p.kind == varKwargs && i != len(specs)-1:
+			err = fmt.Errorf("%s must be the last parameter", spec)
+		case p.kind == varKwargs && (pt.Kind() != reflect.Map || pt.Key().Kind() != reflect.String):
+			err = fmt.Errorf("%s must be a map with string keys, not %s", spec, pt)
+		case p.def != nil:
+			// check the default now, rather than when the script calls.
+			err = decode(nil, p.def, reflect.New(pt).Elem(), p.name)
+		}
+		if err != nil {
+			panic(fmt.Errorf("Params: %v", err))
+		}
+		seen[p.name] = true
+		sawOptional = sawOptional || p.kind == optional
+		sawArgs = sawArgs || p.kind == varArgs
+		params[i] = p
+	}
+	f.params = params
+	return f
+}
+
+// parseParam parses one of the specs given to Params.
+func parseParam(spec string) (param, error) {
+	p := param{spec: spec, name: spec}
+	switch {
+	case strings.HasPrefix(spec, "**"):
+		p.name, p.kind = spec[2:], varKwargs
+	case strings.HasPrefix(spec, "*"):
+		p.name, p.kind = spec[1:], varArgs
+	case strings.HasSuffix(spec, "?"):
+		p.name, p.kind = spec[:len(spec)-1], optional
+	case strings.Contains(spec, "="):
+		i := strings.Index(spec, "=")
+		p.name, p.kind = strings.TrimSpace(spec[:i]), optional
+		v, err := starlark.Eval(&starlark.Thread{Name: "default"}, "", spec[i+1:], nil)
+		if err != nil {
+			return p, fmt.Errorf("bad default for %s: %v", p.name, err)
+		}
+		// defaults are shared between calls, so scripts mustn't change them.
+		v.Freeze()
+		p.def = v
+	}
+	if p.name == "" {
+		return p, fmt.Errorf("parameter %q has no name", spec)
+	}
+	return p, nil
+}
+
+// Doc sets the documentation scripts see for f, and returns f.
+func (f *Function) Doc(doc string) *Function {
+	f.doc = doc
+	return f
+}
+
+// named returns a copy of f with the given name.
+func (f *Function) named(name string) *Function {
+	c := *f
+	c.name = name
+	return &c
+}
+
+// Signature returns f's name and parameters, as in fetch(url, timeout=30).
+func (f *Function) Signature() string {
+	specs := make([]string, len(f.params))
+	for i, p := range f.params {
+		specs[i] = p.spec
+	}
+	return f.name + "(" + strings.Join(specs, ", ") + ")"
+}
+
+// Name returns the name of the function.
+func (f *Function) Name() string { return f.name }
+
+// String returns the string representation of the value.
+func (f *Function) String() string { return "<built-in function " + f.Signature() + ">" }
+
+// Type returns a short string describing the value's type.
+func (f *Function) Type() string { return "builtin_function_or_method" }
+
+// Freeze does nothing, since a Function can't be changed by scripts.
+func (f *Function) Freeze() {}
+
+// Truth returns the truth value of an object.
+func (f *Function) Truth() starlark.Bool { return true }
+
+// Hash returns a function of x such that Equals(x, y) => Hash(x) == Hash(y).
+func (f *Function) Hash() (uint32, error) { return starlark.String(f.name).Hash() }
+
+// Attr returns f's doc or signature.
+func (f *Function) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "doc":
+		return starlark.String(f.doc), nil
+	case "signature":
+		return starlark.String(f.Signature()), nil
+	}
+	return nil, nil
+}
+
+// AttrNames returns the names of f's attributes.
+func (f *Function) AttrNames() []string {
+	return []string{"doc", "signature"}
+}
+
+// CallInternal binds args and kwargs to f's parameters, and calls the go
+// function.
+func (f *Function) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	vals, err := f.bind(args, kwargs)
+	if err != nil {
+		return nil, f.usage(err)
+	}
+	t := f.fn.Type()
+	rvs := make([]reflect.Value, 0, t.NumIn())
+	if f.skip > 0 {
+		rvs = append(rvs, injectArg(thread, t.In(0)))
+	}
+	for i, p := range f.params {
+		pt := t.In(i + f.skip)
+		v := vals[i]
+		if v == nil {
+			v = p.def
+		}
+		dst := reflect.New(pt).Elem()
+		if v != nil {
+			if err := decode(thread, v, dst, p.name); err != nil {
+				return nil, f.usage(err)
+			}
+		}
+		if t.IsVariadic() && i+f.skip == t.NumIn()-1 {
+			// reflect calls variadic functions with the elements of the
+			// slice, not the slice itself.
+			for j := 0; j < dst.Len(); j++ {
+				rvs = append(rvs, dst.Index(j))
+			}
+			continue
+		}
+		rvs = append(rvs, dst)
+	}
+	return callGo(thread, f.name, reflect.Value{}, f.fn, f.skip, rvs)
+}
+
+// bind matches args and kwargs to f's parameters, in the manner of
+// starlark.UnpackArgs.  It returns the value of each parameter, or nil for
+// optional parameters the script didn't pass.  The value of a *parameter is a
+// tuple, and of a **parameter is a dict.
+func (f *Function) bind(args starlark.Tuple, kwargs []starlark.Tuple) ([]starlark.Value, error) {
+	vals := make([]starlark.Value, len(f.params))
+	var rest starlark.Tuple
+	var extra *starlark.Dict
+	restIdx, extraIdx, positional := -1, -1, len(f.params)
+	for i, p := range f.params {
+		switch p.kind {
+		case varArgs:
+			restIdx = i
+			positional = i
+		case varKwargs:
+			extraIdx = i
+			extra = new(starlark.Dict)
+			if positional > i {
+				positional = i
+			}
+		}
+	}
+	for i, v := range args {
+		switch {
+		case i < positional:
+			vals[i] = v
+		case restIdx >= 0:
+			rest = append(rest, v)
+		default:
+			return nil, fmt.Errorf("got %d arguments, want at most %d", len(args), positional)
+		}
+	}
+	for _, kv := range kwargs {
+		name, _ := starlark.AsString(kv[0])
+		i := f.param(name)
+		if i < 0 {
+			if extra == nil {
+				return nil, fmt.Errorf("unexpected keyword argument %s", name)
+			}
+			if _, found, _ := extra.Get(kv[0]); found {
+				return nil, fmt.Errorf("got multiple values for keyword argument %s", name)
+			}
+			if err := extra.SetKey(kv[0], kv[1]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if vals[i] != nil {
+			return nil, fmt.Errorf("got multiple values for parameter %s", name)
+		}
+		vals[i] = kv[1]
+	}
+	for i, p := range f.params {
+		if p.kind == required && vals[i] == nil {
+			return nil, fmt.Errorf("missing argument for %s", p.name)
+		}
+	}
+	if restIdx >= 0 {
+		vals[restIdx] = rest
+	}
+	if extraIdx >= 0 {
+		vals[extraIdx] = extra
+	}
+	return vals, nil
+}
+
+// param returns the index of the parameter that can be passed by the given
+// name, or -1 if there isn't one.
+func (f *Function) param(name string) int {
+	for i, p := range f.params {
+		if p.name == name && (p.kind == required || p.kind == optional) {
+			return i
+		}
+	}
+	return -1
+}
+
+// usage returns err, from passing bad arguments to f, with f's name and
+// signature.
+func (f *Function) usage(err error) error {
+	return fmt.Errorf("%s: %v (usage: %s)", f.name, err, f.Signature())
+}
@@ -1,10 +1,15 @@
 package convert_test
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/starlight-go/starlight"
+	"github.com/starlight-go/starlight/convert"
+	"go.starlark.net/starlark"
 )
 
 func TestVariadic(t *testing.T) {
@@ -36,3 +41,218 @@ do()
 		t.Fatal(err)
 	}
 }
+
+type ctxKey struct{}
+
+type db struct{}
+
+func (db) Query(ctx context.Context, table string, ids ...int) string {
+	return fmt.Sprintf("%v:%s:%v", ctx.Value(ctxKey{}), table, ids)
+}
+
+func TestInjectedArgs(t *testing.T) {
+	globals := map[string]interface{}{
+		"db": db{},
+		"tenant": func(thread *starlark.Thread) string {
+			return thread.Local("tenant").(string)
+		},
+		"deadline": func(ctx context.Context, name string) string {
+			_, ok := ctx.Deadline()
+			return fmt.Sprintf("%s %v", name, ok)
+		},
+	}
+	code := []byte(`
+q = db.Query("users", 1, 2)
+t = tenant()
+d = deadline("x")
+`)
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ctxKey{}, "req"), time.Minute)
+	defer cancel()
+	v, err := starlight.EvalOptions(code, globals, starlight.WithContext(ctx), starlight.WithLocal("tenant", "acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"q": "req:users:[1 2]", "t": "acme", "d": "x true"}
+	for k, e := range expected {
+		if v[k] != e {
+			t.Errorf("expected %s to be %q, got %q", k, e, v[k])
+		}
+	}
+
+	_, err = starlight.Eval([]byte(`deadline()`), globals, nil)
+	if err == nil || err.Error() != "expected 1 args but got 0" {
+		t.Fatalf("expected error about missing args, got %v", err)
+	}
+}
+
+type fetchOptions struct {
+	URL     string `starlark:"url,required"`
+	Timeout int    `starlark:"timeout"`
+	Headers map[string]string
+}
+
+func TestKwargsStruct(t *testing.T) {
+	fetch := func(method string, opts *fetchOptions) string {
+		return fmt.Sprintf("%s %s %d %v", method, opts.URL, opts.Timeout, opts.Headers)
+	}
+	globals := map[string]interface{}{
+		"assert": &assert{t: t},
+		"fetch":  fetch,
+		"post": func(ctx context.Context, opts fetchOptions) string {
+			return fetch("POST", &opts)
+		},
+		"sprint": fmt.Sprint,
+		"save": func(x int, db *fetchOptions) string {
+			return fmt.Sprint(x, db.URL)
+		},
+		"now": time.Now,
+		"sub": func(a, b time.Time) time.Duration { return a.Sub(b) },
+	}
+	code := []byte(`
+assert.Eq("GET x 0 map[]", fetch("GET", url="x"))
+assert.Eq("1x", save(1, url="x"))
+assert.Eq("GET x 5 map[a:b]", fetch("GET", url="x", timeout=5, Headers={"a": "b"}))
+assert.Eq("POST y 0 map[]", post(url="y"))
+`)
+	if _, err := starlight.Eval(code, globals, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []fail{
+		{`fetch("GET", url="x", retries=3)`, "fetch: unexpected keyword argument retries"},
+		{`fetch("GET", timeout=1)`, "fetch: missing argument for url"},
+		{`fetch("GET", url="x", timeout="soon")`, "fetch: cannot decode timeout: expected int (int), but got starlark string"},
+		{`post()`, "expected 1 args but got 0"},
+		{`post(url="y", nope=1)`, "post: unexpected keyword argument nope"},
+		{`fetch("GET")`, "expected 2 args but got 1"},
+		{`save(1)`, "expected 2 args but got 1"},
+		{`sub(now())`, "expected 2 args but got 1"},
+		{`sub(now(), now(), x=1)`, "sub: unexpected keyword argument x"},
+		{`sprint(1, a=2)`, "sprint: unexpected keyword argument a"},
+		{`assert.Eq(1, 1, x=1)`, "Eq: unexpected keyword argument x"},
+	}
+	expectFails(t, tests, globals)
+}
+
+func TestFunc(t *testing.T) {
+	fetch := func(ctx context.Context, url string, timeout int, headers []string, opts map[string]interface{}) string {
+		return fmt.Sprintf("%s %d %v %v", url, timeout, headers, opts)
+	}
+	globals := map[string]interface{}{
+		"assert": &assert{t: t},
+		"fetch": convert.Func(fetch).
+			Params("url", "timeout=30", "*headers", "**opts").
+			Doc("fetch gets a URL."),
+		"join":  convert.Func(strings.Join).Params("elems", `sep=", "`),
+		"plain": convert.Func(fmt.Sprint),
+		"named": convert.Func(func(a, b string, c ...int) string { return fmt.Sprint(a, b, c) }).Params("a", "b?", "c?"),
+	}
+	code := []byte(`
+assert.Eq("x 30 [] map[]", fetch("x"))
+assert.Eq("x 5 [] map[]", fetch(timeout=5, url="x"))
+assert.Eq("x 5 [a b] map[]", fetch("x", 5, "a", "b"))
+assert.Eq("x 30 [] map[retry:true]", fetch("x", retry=True))
+assert.Eq("a, b", join(["a", "b"]))
+assert.Eq("a-b", join(["a", "b"], sep="-"))
+assert.Eq("1 2", plain(1, " ", 2))
+assert.Eq("a[1 2]", named("a", c=[1, 2]))
+assert.Eq("fetch gets a URL.", fetch.doc)
+assert.Eq("fetch(url, timeout=30, *headers, **opts)", fetch.signature)
+assert.Eq("<built-in function join(elems, sep=\", \")>", str(join))
+assert.Eq("plain(*args)", plain.signature)
+`)
+	if _, err := starlight.Eval(code, globals, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []fail{
+		{`fetch()`, "fetch: missing argument for url (usage: fetch(url, timeout=30, *headers, **opts))"},
+		{`fetch("x", url="y")`, "fetch: got multiple values for parameter url (usage: fetch(url, timeout=30, *headers, **opts))"},
+		{`fetch("x", timeout="soon")`, "fetch: cannot decode timeout: expected int (int), but got starlark string (usage: fetch(url, timeout=30, *headers, **opts))"},
+		{`join(["a"], ",", 1)`, `join: got 3 arguments, want at most 2 (usage: join(elems, sep=", "))`},
+		{`join(["a"], step=1)`, `join: unexpected keyword argument step (usage: join(elems, sep=", "))`},
+	}
+	expectFails(t, tests, globals)
+}
+
+func TestFuncBadParams(t *testing.T) {
+	tests := []struct {
+		fn    interface{}
+		specs []string
+		err   string
+	}{
+		{strings.Join, []string{"elems"}, "Params: function has 2 parameters, but 1 were given"},
+		{strings.Join, []string{"elems=[]", "sep"}, "Params: required parameter sep follows an optional one"},
+		{strings.Join, []string{"elems", "sep=1"}, "Params: cannot decode sep: expected string, but got starlark int"},
+		{strings.Join, []string{"*elems", "*sep"}, "Params: more than one *parameter"},
+		{strings.Join, []string{"elems", "*sep"}, "Params: *sep must be a slice, not string"},
+		{strings.Join, []string{"elems", "sep=("}, "Params: bad default for sep: :1:2: got end of file, want primary expression"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.specs, ","), func(t *testing.T) {
+			defer func() {
+				r := recover()
+				err, _ := r.(error)
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected panic %q, got %v", test.err, r)
+				}
+			}()
+			convert.Func(test.fn).Params(test.specs...)
+		})
+	}
+}
+
+type item struct {
+	Name  string
+	Price int
+}
+
+func TestCallbacks(t *testing.T) {
+	items := []item{{"a", 1}, {"b", 5}, {"c", 10}}
+	globals := map[string]interface{}{
+		"assert": &assert{t: t},
+		"filter": func(keep func(item) bool) []string {
+			var names []string
+			for _, it := range items {
+				if keep(it) {
+					names = append(names, it.Name)
+				}
+			}
+			return names
+		},
+		"total": func(price func(item) (int, error)) (int, error) {
+			sum := 0
+			for _, it := range items {
+				p, err := price(it)
+				if err != nil {
+					return 0, err
+				}
+				sum += p
+			}
+			return sum, nil
+		},
+		"apply": convert.Func(func(f func(string, ...int) (string, int), s string) string {
+			str, n := f(s, 1, 2)
+			return fmt.Sprint(str, n)
+		}).Params("f", "s"),
+	}
+	code := []byte(`
+def expensive(it):
+	return it.Price > 2
+assert.Eq(["b", "c"], list(filter(expensive)))
+assert.Eq(["a"], list(filter(lambda it: it.Name == "a")))
+assert.Eq(32, total(lambda it: it.Price * 2))
+assert.Eq("x3", apply(lambda s, *n: (s, len(n) + 1), s="x"))
+`)
+	if _, err := starlight.Eval(code, globals, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []fail{
+		{`filter(lambda it: it.Nope)`, "starlight_struct<convert_test.item> has no .Nope field or method"},
+		{`filter(lambda it: 1)`, "cannot decode lambda result: expected bool, but got starlark int"},
+		{`total(lambda it: fail("no price"))`, "fail: no price"},
+		{`apply(lambda s, *n: s, "x")`, "lambda: expected a tuple of 2 values, but got string"},
+	}
+	expectFails(t, tests, globals)
+}
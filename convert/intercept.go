@@ -0,0 +1,104 @@
+package convert
+
+import (
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+// InterceptorLocal is the name of the thread-local value that holds the
+// Interceptor for calls made on the thread, if there is one.
+const InterceptorLocal = "github.com/starlight-go/starlight.interceptor"
+
+// CallInfo describes a call a script makes to a go function or method.
+type CallInfo struct {
+	// Thread is the thread the script is running on.
+	Thread *starlark.Thread
+	// Name is the name of the function or method.
+	Name string
+	// Recv is the value whose method is being called, or nil for functions.
+	Recv interface{}
+	// Args are the arguments the function will be called with, converted
+	// to go values.  They don't include a context.Context or
+	// *starlark.Thread parameter filled from the thread.
+	Args []interface{}
+}
+
+// Interceptor is called instead of each go function or method that a script
+// calls, if it is stored in the thread's InterceptorLocal value.  Calling
+// proceed calls the function, and returns its results, without any trailing
+// error, and the error the function returned.  An Interceptor can veto the
+// call by returning an error without calling proceed.  If the Interceptor
+// returns an error, the script gets that error instead of the call's result.
+// If it returns nil without calling proceed, the call returns None.
+type Interceptor func(call CallInfo, proceed func() ([]interface{}, error)) error
+
+// callGo calls gofn with args, which include the skip parameters filled from
+// the thread, through the thread's Interceptor if it has one.  Recv is the
+// receiver of the method gofn, if it is one.  The results follow the thread's
+// Policy, if it has one.
+func callGo(thread *starlark.Thread, name string, recv, gofn reflect.Value, skip int, args []reflect.Value) (v starlark.Value, err error) {
+	defer func() {
+		// a starlark function passed to gofn as a func failed, and the
+		// func couldn't return the error.
+		if r := recover(); r != nil {
+			p, ok := r.(callbackPanic)
+			if !ok {
+				panic(r)
+			}
+			v, err = starlark.None, p.err
+		}
+	}()
+	v, err = intercept(thread, name, recv, gofn, skip, args)
+	if p, ok := thread.Local(PolicyLocal).(*Policy); ok && v != nil {
+		restrict(v, p)
+	}
+	return v, err
+}
+
+func intercept(thread *starlark.Thread, name string, recv, gofn reflect.Value, skip int, args []reflect.Value) (starlark.Value, error) {
+	ic, _ := thread.Local(InterceptorLocal).(Interceptor)
+	if ic == nil {
+		return makeOut(gofn.Call(args))
+	}
+	info := CallInfo{
+		Thread: thread,
+		Name:   name,
+		Args:   make([]interface{}, 0, len(args)-skip),
+	}
+	if recv.IsValid() && recv.CanInterface() {
+		info.Recv = recv.Interface()
+	}
+	for _, arg := range args[skip:] {
+		info.Args = append(info.Args, arg.Interface())
+	}
+	var out []reflect.Value
+	proceed := func() ([]interface{}, error) {
+		out = gofn.Call(args)
+		return results(out)
+	}
+	if err := ic(info, proceed); err != nil {
+		return starlark.None, err
+	}
+	if out == nil {
+		return starlark.None, nil
+	}
+	return makeOut(out)
+}
+
+// results returns the go values of a function's results, and its trailing
+// error, if it returns one.
+func results(out []reflect.Value) ([]interface{}, error) {
+	var err error
+	if len(out) > 0 && out[len(out)-1].Type() == errType {
+		if v := out[len(out)-1].Interface(); v != nil {
+			err = v.(error)
+		}
+		out = out[:len(out)-1]
+	}
+	vals := make([]interface{}, len(out))
+	for i, v := range out {
+		vals[i] = v.Interface()
+	}
+	return vals, err
+}
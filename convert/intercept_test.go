@@ -0,0 +1,79 @@
+package convert_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/starlight-go/starlight"
+	"github.com/starlight-go/starlight/convert"
+)
+
+type account struct {
+	Balance int
+}
+
+func (a *account) Withdraw(amount int) (int, error) {
+	if amount > a.Balance {
+		return a.Balance, errors.New("insufficient funds")
+	}
+	a.Balance -= amount
+	return a.Balance, nil
+}
+
+func TestInterceptor(t *testing.T) {
+	acct := &account{Balance: 10}
+	deleted := false
+	globals := map[string]interface{}{
+		"acct":  acct,
+		"greet": func(ctx context.Context, names ...string) string { return "hi " + strings.Join(names, ", ") },
+		"rm":    func(path string) { deleted = true },
+	}
+	var log []string
+	ic := func(call convert.CallInfo, proceed func() ([]interface{}, error)) error {
+		if call.Name == "rm" {
+			return fmt.Errorf("%s is not allowed", call.Name)
+		}
+		res, err := proceed()
+		log = append(log, fmt.Sprintf("%T.%s%v -> %v, %v", call.Recv, call.Name, call.Args, res, err))
+		return err
+	}
+	code := []byte(`
+g = greet("bob", "sue")
+b = acct.Withdraw(3)
+`)
+	v, err := starlight.EvalOptions(code, globals, starlight.WithInterceptor(ic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["g"] != "hi bob, sue" || v["b"] != int64(7) {
+		t.Fatalf("unexpected results %v", v)
+	}
+	expected := []string{
+		"<nil>.greet[bob sue] -> [hi bob, sue], <nil>",
+		"*convert_test.account.Withdraw[3] -> [7], <nil>",
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("expected log\n%q\ngot\n%q", expected, log)
+	}
+
+	log = nil
+	_, err = starlight.EvalOptions([]byte(`acct.Withdraw(100)`), globals, starlight.WithInterceptor(ic))
+	if err == nil || err.Error() != "insufficient funds" {
+		t.Fatalf("expected error from Withdraw, got %v", err)
+	}
+	if len(log) != 1 || log[0] != "*convert_test.account.Withdraw[100] -> [7], insufficient funds" {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	_, err = starlight.EvalOptions([]byte(`rm("/")`), globals, starlight.WithInterceptor(ic))
+	if err == nil || err.Error() != "rm is not allowed" {
+		t.Fatalf("expected veto error, got %v", err)
+	}
+	if deleted {
+		t.Fatal("vetoed function was called")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 
 	"go.starlark.net/starlark"
 )
@@ -40,12 +41,18 @@ func makeGoInterface(val reflect.Value) (*GoInterface, bool) {
 // types will not behave as their base type (you can't add 2 to an ID, even if
 // it is an int underneath).
 type GoInterface struct {
-	v reflect.Value
+	v      reflect.Value
+	frozen bool
+	mu     *sync.RWMutex
+	policy *Policy
 }
 
 // Attr returns a starlark value that wraps the method or field with the given
 // name.
 func (g *GoInterface) Attr(name string) (starlark.Value, error) {
+	if !g.policy.Allows(g.v.Type(), name) {
+		return nil, denied(g, name)
+	}
 	switch name {
 	case "toInt":
 		return MakeStarFn(name, g.ToInt), nil
@@ -61,7 +68,7 @@ func (g *GoInterface) Attr(name string) (starlark.Value, error) {
 
 	method := g.v.MethodByName(name)
 	if method.Kind() != reflect.Invalid {
-		return makeStarFn(name, method), nil
+		return methodValue(g, g.v, name, method, "value")
 	}
 	return nil, nil
 }
@@ -83,12 +90,13 @@ func (g *GoInterface) AttrNames() []string {
 			names = append(names, t.Method(i).Name)
 		}
 	}
-	return names
+	return filterNames(g.policy, g.v.Type(), names)
 }
 
 // String returns the string representation of the value.
 // Starlark string values are quoted as if by Python's repr.
 func (g *GoInterface) String() string {
+	defer rlock(g.mu)()
 	return fmt.Sprint(g.v.Interface())
 }
 
@@ -103,10 +111,16 @@ func (g *GoInterface) Type() string {
 // structure through this API will fail dynamically, making the
 // data structure immutable and safe for publishing to other
 // Starlark interpreters running concurrently.
-func (g *GoInterface) Freeze() {}
+//
+// A frozen value's methods with pointer receivers, which may change the
+// value, can't be called, and the values its methods return are frozen too.
+func (g *GoInterface) Freeze() {
+	g.frozen = true
+}
 
 // Truth returns the truth value of an object.
 func (g *GoInterface) Truth() starlark.Bool {
+	defer rlock(g.mu)()
 	switch g.v.Kind() {
 	case reflect.Ptr:
 		return starlark.Bool(!g.v.IsNil())
@@ -138,6 +152,7 @@ func (g *GoInterface) Hash() (uint32, error) {
 // ToInt converts the interface value into a starlark int.  This will fail if
 // the underlying type is not an int type or pointer to an int type.
 func (g *GoInterface) ToInt() (int64, error) {
+	defer rlock(g.mu)()
 	v := g.v
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
@@ -152,6 +167,7 @@ func (g *GoInterface) ToInt() (int64, error) {
 // ToBool converts the interface value into a starlark bool.  This will fail if
 // the underlying type is not a bool type or pointer to a bool type.
 func (g *GoInterface) ToBool() (bool, error) {
+	defer rlock(g.mu)()
 	v := g.v
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
@@ -166,6 +182,7 @@ func (g *GoInterface) ToBool() (bool, error) {
 // ToUint converts the interface value into a starlark int.  This will fail if
 // the underlying type is not a uint type or pointer to an uint type.
 func (g *GoInterface) ToUint() (uint64, error) {
+	defer rlock(g.mu)()
 	v := g.v
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
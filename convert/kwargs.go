@@ -0,0 +1,68 @@
+package convert
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+// optionsParam reports whether the last parameter of the go function type t,
+// which has skip injected parameters, can be filled from keyword arguments.
+// It can if it's a struct or a pointer to a struct.
+func optionsParam(t reflect.Type, skip int) bool {
+	if t.NumIn() <= skip || t.IsVariadic() {
+		return false
+	}
+	last := t.In(t.NumIn() - 1)
+	if last.Kind() == reflect.Ptr {
+		last = last.Elem()
+	}
+	return last.Kind() == reflect.Struct
+}
+
+// fromKwargs returns a new value of type t, which is a struct or a pointer to
+// a struct, with its fields filled from kwargs.  Fields are matched by name as
+// with DecodeStringDict, and their values converted as with Decode.  It is an
+// error to pass a keyword argument that matches no field, to pass one more
+// than once, or to leave out a field tagged `starlark:",required"`.  Fnname is
+// the name of the function being called, for error messages.
+func fromKwargs(thread *starlark.Thread, fnname string, kwargs []starlark.Tuple, t reflect.Type) (reflect.Value, error) {
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		t = t.Elem()
+	}
+	out := reflect.New(t).Elem()
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := fieldName(t.Field(i)); ok {
+			fields[name] = i
+		}
+	}
+	set := make(map[string]bool, len(kwargs))
+	for _, kv := range kwargs {
+		name, _ := starlark.AsString(kv[0])
+		i, ok := fields[name]
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("%s: unexpected keyword argument %s", fnname, name)
+		}
+		if set[name] {
+			return reflect.Value{}, fmt.Errorf("%s: got multiple values for keyword argument %s", fnname, name)
+		}
+		set[name] = true
+		if err := decode(thread, kv[1], out.Field(i), name); err != nil {
+			return reflect.Value{}, fmt.Errorf("%s: %v", fnname, err)
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := fieldName(f)
+		if ok && !set[name] && fieldRequired(f) {
+			return reflect.Value{}, fmt.Errorf("%s: missing argument for %s", fnname, name)
+		}
+	}
+	if ptr {
+		return out.Addr(), nil
+	}
+	return out, nil
+}
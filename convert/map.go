@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"sync"
 
 	"go.starlark.net/starlark"
 )
@@ -20,6 +21,8 @@ type GoMap struct {
 	v      reflect.Value
 	numIt  int
 	frozen bool
+	mu     *sync.RWMutex
+	policy *Policy
 }
 
 // NewGoMap wraps the given map m in a new GoMap.  This function will panic if m
@@ -37,6 +40,7 @@ func (g *GoMap) SetKey(k, v starlark.Value) (err error) {
 	if g.frozen {
 		return fmt.Errorf("cannot insert into frozen map")
 	}
+	defer lock(g.mu)()
 	if g.numIt > 0 {
 		return fmt.Errorf("cannot insert into map during iteration")
 	}
@@ -62,11 +66,13 @@ func (g *GoMap) SetKey(k, v starlark.Value) (err error) {
 
 // Get implements starlark.Mapping.
 func (g *GoMap) Get(in starlark.Value) (out starlark.Value, found bool, err error) {
-	v := g.v.MapIndex(conv(in, g.v.Type().Key()))
+	key := conv(in, g.v.Type().Key())
+	defer rlock(g.mu)()
+	v := g.v.MapIndex(key)
 	if v.Kind() == reflect.Invalid {
 		return starlark.None, false, nil
 	}
-	val, err := toValue(v)
+	val, err := toChild(v, g)
 	if err != nil {
 		return nil, false, err
 	}
@@ -76,6 +82,7 @@ func (g *GoMap) Get(in starlark.Value) (out starlark.Value, found bool, err erro
 // String returns the string representation of the value.
 // Starlark string values are quoted as if by Python's repr.
 func (g *GoMap) String() string {
+	defer rlock(g.mu)()
 	return fmt.Sprint(g.v.Interface())
 }
 
@@ -96,6 +103,7 @@ func (g *GoMap) Freeze() {
 
 // Truth returns the truth value of an object.
 func (g *GoMap) Truth() starlark.Bool {
+	defer rlock(g.mu)()
 	return g.v.Len() > 0
 }
 
@@ -110,6 +118,7 @@ func (g *GoMap) Clear() error {
 	if g.frozen {
 		return fmt.Errorf("cannot clear frozen map")
 	}
+	defer lock(g.mu)()
 	if g.numIt > 0 {
 		return fmt.Errorf("cannot clear map during iteration")
 	}
@@ -123,13 +132,15 @@ func (g *GoMap) Delete(k starlark.Value) (v starlark.Value, found bool, err erro
 	if g.frozen {
 		return nil, false, fmt.Errorf("cannot delete from frozen map")
 	}
+	key := conv(k, g.v.Type().Key())
+	defer lock(g.mu)()
 	if g.numIt > 0 {
 		return nil, false, fmt.Errorf("cannot delete from map during iteration")
 	}
-	key := conv(k, g.v.Type().Key())
 	return g.delete(key)
 }
 
+// delete removes key from the map.  The caller must hold the write lock.
 func (g *GoMap) delete(key reflect.Value) (v starlark.Value, found bool, err error) {
 	val := g.v.MapIndex(key)
 	if val.Kind() == reflect.Invalid {
@@ -145,15 +156,16 @@ func (g *GoMap) delete(key reflect.Value) (v starlark.Value, found bool, err err
 }
 
 func (g *GoMap) Items() []starlark.Tuple {
+	defer rlock(g.mu)()
 	tuples := make([]starlark.Tuple, 0, g.v.Len())
 	var err error
 	for _, k := range g.v.MapKeys() {
 		tuple := make(starlark.Tuple, 2)
-		tuple[0], err = toValue(k)
+		tuple[0], err = toChild(k, g)
 		if err != nil {
 			panic(err)
 		}
-		tuple[1], err = toValue(g.v.MapIndex(k))
+		tuple[1], err = toChild(g.v.MapIndex(k), g)
 		if err != nil {
 			panic(err)
 		}
@@ -163,9 +175,10 @@ func (g *GoMap) Items() []starlark.Tuple {
 }
 
 func (g *GoMap) Keys() []starlark.Value {
+	defer rlock(g.mu)()
 	keys := make([]starlark.Value, 0, g.v.Len())
 	for _, k := range g.v.MapKeys() {
-		key, err := toValue(k)
+		key, err := toChild(k, g)
 		if err != nil {
 			panic(err)
 		}
@@ -175,10 +188,12 @@ func (g *GoMap) Keys() []starlark.Value {
 }
 
 func (g *GoMap) Len() int {
+	defer rlock(g.mu)()
 	return g.v.Len()
 }
 
 func (g *GoMap) Iterate() starlark.Iterator {
+	defer lock(g.mu)()
 	g.numIt++
 	return &mapIterator{
 		g:    g,
@@ -187,11 +202,14 @@ func (g *GoMap) Iterate() starlark.Iterator {
 }
 
 func (g *GoMap) Attr(name string) (starlark.Value, error) {
+	if !g.policy.Allows(g.v.Type(), name) {
+		return nil, denied(g, name)
+	}
 	return mapAttr(g, name, dictMethods)
 }
 
 func (g *GoMap) AttrNames() []string {
-	return mapAttrNames(dictMethods)
+	return filterNames(g.policy, g.v.Type(), mapAttrNames(dictMethods))
 }
 
 type builtinMapMethod func(fnname string, recv *GoMap, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
@@ -239,7 +257,7 @@ type mapIterator struct {
 
 func (it *mapIterator) Next(p *starlark.Value) bool {
 	if it.i < len(it.keys) {
-		v, err := toValue(it.keys[it.i])
+		v, err := toChild(it.keys[it.i], it.g)
 		if err != nil {
 			panic(err)
 		}
@@ -251,6 +269,7 @@ func (it *mapIterator) Next(p *starlark.Value) bool {
 }
 
 func (it *mapIterator) Done() {
+	defer lock(it.g.mu)()
 	it.g.numIt--
 }
 
@@ -320,6 +339,13 @@ func dict_popitem(fnname string, g *GoMap, args starlark.Tuple, _ []starlark.Tup
 	if len(args) > 0 {
 		return nil, fmt.Errorf("%s: wanted 0 args, got %d", fnname, len(args))
 	}
+	if g.frozen {
+		return nil, fmt.Errorf("cannot delete from frozen map")
+	}
+	defer lock(g.mu)()
+	if g.numIt > 0 {
+		return nil, fmt.Errorf("cannot delete from map during iteration")
+	}
 	keys := g.v.MapKeys()
 	if len(keys) == 0 {
 		return nil, fmt.Errorf("popitem: empty dict")
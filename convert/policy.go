@@ -0,0 +1,225 @@
+package convert
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.starlark.net/starlark"
+)
+
+// PolicyLocal is the name of the thread-local value that holds the Policy for
+// the go values returned by functions called on the thread, if there is one.
+const PolicyLocal = "github.com/starlight-go/starlight.policy"
+
+// Policy restricts which fields and methods of go values scripts can reach.
+// Rules name a go type and a field or method of it, and either allow or deny
+// scripts access to that member.  Both names may use the wildcards * (any
+// run of characters) and ? (any one character).
+//
+// A type is named as it prints with %T, such as "*http.Request" or
+// "http.Request", or by its full package path, such as "net/http.Request".
+// Rules for a struct type also apply to pointers to it.  The methods of go
+// maps and slices, such as "keys" and "append", are members of the map or
+// slice type, such as "map[string]int".
+//
+// Read rules don't restrict anything: they mark methods that only read their
+// receiver, which can then be called on frozen values.
+//
+// Deny rules win over allow rules.  If any allow rule matches a type, only
+// the members that allow rules match are reachable on it.  Members of types
+// that no allow rule matches are reachable unless a deny rule matches them.
+//
+// A Policy must not be changed once values that use it have been given to
+// scripts.
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	typ, member string
+	allow       bool
+	reads       bool
+}
+
+// NewPolicy returns an empty Policy, which allows everything.
+func NewPolicy() *Policy {
+	return &Policy{}
+}
+
+// Allow adds a rule allowing scripts to reach the members of typ that match
+// member, and returns p so calls can be chained.
+func (p *Policy) Allow(typ, member string) *Policy {
+	p.rules = append(p.rules, rule{typ: typ, member: member, allow: true})
+	return p
+}
+
+// Deny adds a rule stopping scripts from reaching the members of typ that
+// match member, and returns p so calls can be chained.
+func (p *Policy) Deny(typ, member string) *Policy {
+	p.rules = append(p.rules, rule{typ: typ, member: member})
+	return p
+}
+
+// Read adds a rule marking the methods of typ that match member as ones that
+// don't modify their receiver, and returns p so calls can be chained.  Methods
+// with pointer receivers may modify the value, so they can't be called on
+// frozen values, such as those from ReadOnly, unless a read rule matches them.
+// On synchronized values, they hold the lock for reading rather than writing.
+func (p *Policy) Read(typ, member string) *Policy {
+	p.rules = append(p.rules, rule{typ: typ, member: member, reads: true})
+	return p
+}
+
+// Allows reports whether p lets scripts reach the member with the given name
+// of values of type t.  A nil Policy allows everything.
+func (p *Policy) Allows(t reflect.Type, member string) bool {
+	if p == nil {
+		return true
+	}
+	names := typeNames(t)
+	typed, allowed := false, false
+	for _, r := range p.rules {
+		if r.reads || !matchType(r.typ, names) {
+			continue
+		}
+		matched := glob(r.member, member)
+		if !r.allow {
+			if matched {
+				return false
+			}
+			continue
+		}
+		typed = true
+		allowed = allowed || matched
+	}
+	return allowed || !typed
+}
+
+// reads reports whether a read rule in p matches the method with the given
+// name of values of type t.
+func (p *Policy) reads(t reflect.Type, method string) bool {
+	if p == nil {
+		return false
+	}
+	names := typeNames(t)
+	for _, r := range p.rules {
+		if r.reads && matchType(r.typ, names) && glob(r.member, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted converts v as with ToValue, and makes p decide which fields and
+// methods scripts can reach on the result, and on the values read from it.
+// Members p doesn't allow are hidden: reading them fails as if they didn't
+// exist, hasattr and dir don't report them, and they can't be set.
+//
+// Restricted panics if v can't be converted.
+func Restricted(v interface{}, p *Policy) starlark.Value {
+	val, err := ToValue(v)
+	if err != nil {
+		panic(err)
+	}
+	setPolicy(val, p)
+	return val
+}
+
+// setPolicy makes v, if it wraps a go value, follow p.
+func setPolicy(v starlark.Value, p *Policy) {
+	switch v := v.(type) {
+	case *GoStruct:
+		v.policy = p
+	case *GoInterface:
+		v.policy = p
+	case *GoMap:
+		v.policy = p
+	case *GoSlice:
+		v.policy = p
+	}
+}
+
+// restrict makes v, or the values in v if it's a tuple of results, follow p,
+// unless they already follow a policy.
+func restrict(v starlark.Value, p *Policy) {
+	if t, ok := v.(starlark.Tuple); ok {
+		for _, v := range t {
+			restrict(v, p)
+		}
+		return
+	}
+	if _, _, policy := shared(v); policy == nil {
+		setPolicy(v, p)
+	}
+}
+
+// denied returns the error for reading a member p doesn't allow.  It's a
+// starlark.NoSuchAttrError, so hasattr reports the member as missing.
+func denied(v starlark.Value, name string) error {
+	return starlark.NoSuchAttrError(fmt.Sprintf("%s has no .%s field or method (not allowed by policy)", v.Type(), name))
+}
+
+// filterNames returns the names that p allows on values of type t.
+func filterNames(p *Policy, t reflect.Type, names []string) []string {
+	if p == nil {
+		return names
+	}
+	allowed := names[:0]
+	for _, name := range names {
+		if p.Allows(t, name) {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
+}
+
+// typeNames returns the names rules may use for t.
+func typeNames(t reflect.Type) []string {
+	names := []string{t.String()}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		names = append(names, t.String())
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		names = append(names, t.PkgPath()+"."+t.Name())
+	}
+	return names
+}
+
+func matchType(pattern string, names []string) bool {
+	for _, name := range names {
+		if glob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// glob reports whether s matches pattern, in which * matches any run of
+// characters and ? matches any one character.  Unlike path.Match, nothing
+// else is special, since type names are full of brackets and slashes.
+func glob(pattern, s string) bool {
+	// star and next record where to resume after the last *, so a failed
+	// match can backtrack by letting the * swallow one more character.
+	star, next := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
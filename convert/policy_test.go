@@ -0,0 +1,99 @@
+package convert_test
+
+import (
+	"testing"
+
+	"github.com/starlight-go/starlight"
+	"github.com/starlight-go/starlight/convert"
+)
+
+type member struct {
+	Name   string
+	Secret string
+	Limits map[string]int
+	Tags   []string
+	owner  *member
+}
+
+func (a *member) Owner() *member {
+	return a.owner
+}
+
+func (a *member) DeleteAll() {
+	a.Tags = nil
+}
+
+func TestPolicy(t *testing.T) {
+	p := convert.NewPolicy().
+		Deny("convert_test.member", "Secret").
+		Deny("*", "Delete*").
+		Deny("map[string]int", "pop*").
+		Allow("[]string", "index")
+	a := &member{
+		Name:   "bob",
+		Secret: "hunter2",
+		Limits: map[string]int{"x": 1},
+		Tags:   []string{"a"},
+		owner:  &member{Name: "alice", Secret: "swordfish"},
+	}
+	globals := map[string]interface{}{
+		"assert": &assert{t: t},
+		"a":      convert.Restricted(a, p),
+	}
+	code := []byte(`
+assert.Eq("bob", a.Name)
+assert.Eq("alice", a.Owner().Name)
+assert.Eq(False, hasattr(a, "Secret"))
+assert.Eq(False, hasattr(a.Owner(), "Secret"))
+assert.Eq(False, "Secret" in dir(a))
+assert.Eq(False, "DeleteAll" in dir(a))
+assert.Eq(True, "Name" in dir(a))
+assert.Eq(1, a.Limits.get("x"))
+assert.Eq(False, hasattr(a.Limits, "pop"))
+assert.Eq(0, a.Tags.index("a"))
+assert.Eq(["index"], dir(a.Tags))
+`)
+	if _, err := starlight.Eval(code, globals, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []fail{
+		{`a.Secret`, "starlight_struct<*convert_test.member> has no .Secret field or method (not allowed by policy)"},
+		{`a.Owner().Secret`, "starlight_struct<*convert_test.member> has no .Secret field or method (not allowed by policy)"},
+		{`a.Secret = "x"`, "cannot set field Secret of starlight_struct<*convert_test.member>: not allowed by policy"},
+		{`a.DeleteAll()`, "starlight_struct<*convert_test.member> has no .DeleteAll field or method (not allowed by policy)"},
+		{`a.Limits.popitem()`, "starlight_map<map[string]int> has no .popitem field or method (not allowed by policy)"},
+		{`a.Tags.append("b")`, "starlight_slice<[]string> has no .append field or method (not allowed by policy)"},
+	}
+	expectFails(t, tests, globals)
+	if a.Secret != "hunter2" || len(a.Tags) != 1 {
+		t.Fatalf("script changed a restricted value: %+v", a)
+	}
+}
+
+func TestPolicyTypeNames(t *testing.T) {
+	tests := []struct {
+		typ  string
+		deny bool
+	}{
+		{"convert_test.member", true},
+		{"*convert_test.member", true},
+		{"github.com/starlight-go/starlight/convert_test.member", true},
+		{"github.com/*.member", true},
+		{"*.mem?er", true},
+		{"convert_test.mem", false},
+		{"other.member", false},
+	}
+	for _, test := range tests {
+		t.Run(test.typ, func(t *testing.T) {
+			p := convert.NewPolicy().Deny(test.typ, "Name")
+			globals := map[string]interface{}{
+				"a": convert.Restricted(&member{}, p),
+			}
+			_, err := starlight.Eval([]byte(`a.Name`), globals, nil)
+			if denied := err != nil; denied != test.deny {
+				t.Fatalf("expected denied to be %v, got error %v", test.deny, err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"sync"
 
 	"go.starlark.net/starlark"
 )
@@ -19,6 +20,8 @@ type GoSlice struct {
 	v      reflect.Value
 	numIt  int
 	frozen bool
+	mu     *sync.RWMutex
+	policy *Policy
 }
 
 // NewGoMap wraps the given slice in a new GoSlice.  This function will panic if m
@@ -34,6 +37,7 @@ func NewGoSlice(slice interface{}) *GoSlice {
 // String returns the string representation of the value.
 // Starlark string values are quoted as if by Python's repr.
 func (g *GoSlice) String() string {
+	defer rlock(g.mu)()
 	return fmt.Sprint(g.v.Interface())
 }
 
@@ -54,6 +58,7 @@ func (g *GoSlice) Freeze() {
 
 // Truth returns the truth value of an object.
 func (g *GoSlice) Truth() starlark.Bool {
+	defer rlock(g.mu)()
 	return g.v.Len() > 0
 }
 
@@ -65,6 +70,7 @@ func (g *GoSlice) Hash() (uint32, error) {
 }
 
 func (g *GoSlice) Clear() error {
+	defer lock(g.mu)()
 	if err := g.checkMutable("clear"); err != nil {
 		return err
 	}
@@ -73,7 +79,8 @@ func (g *GoSlice) Clear() error {
 }
 
 func (g *GoSlice) Index(i int) starlark.Value {
-	v, err := toValue(g.v.Index(i))
+	defer rlock(g.mu)()
+	v, err := toChild(g.v.Index(i), g)
 	if err != nil {
 		panic(err)
 	}
@@ -81,27 +88,33 @@ func (g *GoSlice) Index(i int) starlark.Value {
 }
 
 func (g *GoSlice) SetIndex(index int, v starlark.Value) error {
+	val := conv(v, g.v.Type().Elem())
+	defer lock(g.mu)()
 	if err := g.checkMutable("assign to"); err != nil {
 		return err
 	}
-	val := conv(v, g.v.Type().Elem())
 	g.v.Index(index).Set(val)
 	return nil
 }
 
 func (g *GoSlice) Slice(start, end, step int) starlark.Value {
+	defer rlock(g.mu)()
 	// python slices are copies, so we don't just use .Slice here
 	if step == 1 {
 		copy := reflect.MakeSlice(g.v.Type(), end-start, end-start)
 		reflect.Copy(copy, g.v.Slice(start, end))
-		return &GoSlice{v: copy}
+		s := &GoSlice{v: copy}
+		inherit(s, g)
+		return s
 	}
 	copy := reflect.MakeSlice(g.v.Type().Elem(), 0, 0)
 	sign := signOf(step)
 	for i := start; signOf(end-i) == sign; i += step {
 		copy = reflect.Append(copy, g.v.Index(i))
 	}
-	return &GoSlice{v: copy}
+	s := &GoSlice{v: copy}
+	inherit(s, g)
+	return s
 }
 
 func signOf(i int) int {
@@ -117,10 +130,12 @@ func signOf(i int) int {
 }
 
 func (g *GoSlice) Len() int {
+	defer rlock(g.mu)()
 	return g.v.Len()
 }
 
 func (g *GoSlice) Iterate() starlark.Iterator {
+	defer lock(g.mu)()
 	g.numIt++
 	return &sliceIterator{
 		g: g,
@@ -128,11 +143,14 @@ func (g *GoSlice) Iterate() starlark.Iterator {
 }
 
 func (g *GoSlice) Attr(name string) (starlark.Value, error) {
+	if !g.policy.Allows(g.v.Type(), name) {
+		return nil, denied(g, name)
+	}
 	return sliceAttr(g, name, sliceMethods)
 }
 
 func (g *GoSlice) AttrNames() []string {
-	return sliceAttrNames(sliceMethods)
+	return filterNames(g.policy, g.v.Type(), sliceAttrNames(sliceMethods))
 }
 
 type builtinSliceMethod func(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
@@ -175,8 +193,9 @@ type sliceIterator struct {
 }
 
 func (it *sliceIterator) Next(p *starlark.Value) bool {
+	defer rlock(it.g.mu)()
 	if it.i < it.g.v.Len() {
-		v, err := toValue(it.g.v.Index(it.i))
+		v, err := toChild(it.g.v.Index(it.i), it.g)
 		if err != nil {
 			panic(err)
 		}
@@ -188,7 +207,8 @@ func (it *sliceIterator) Next(p *starlark.Value) bool {
 }
 
 // checkMutable reports an error if the slicve should not be mutated.
-// verb+" slice" should describe the operation.
+// verb+" slice" should describe the operation.  The caller must hold the
+// write lock.
 func (g *GoSlice) checkMutable(verb string) error {
 	if g.frozen {
 		return fmt.Errorf("cannot %s frozen slice", verb)
@@ -200,6 +220,7 @@ func (g *GoSlice) checkMutable(verb string) error {
 }
 
 func (it *sliceIterator) Done() {
+	defer lock(it.g.mu)()
 	it.g.numIt--
 }
 
@@ -208,10 +229,11 @@ func list_append(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starla
 	if len(args) != 1 {
 		return nil, fmt.Errorf("append: got %d arguments, want 1", len(args))
 	}
+	v := conv(args[0], g.v.Type().Elem())
+	defer lock(g.mu)()
 	if err := g.checkMutable("append to"); err != nil {
 		return nil, err
 	}
-	v := conv(args[0], g.v.Type().Elem())
 	g.v = reflect.Append(g.v, v)
 	return starlark.None, nil
 }
@@ -229,21 +251,24 @@ func list_extend(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starla
 	if len(args) != 1 {
 		return nil, fmt.Errorf("extend: got %d arguments, want 1", len(args))
 	}
-	if err := g.checkMutable("extend"); err != nil {
-		return nil, err
-	}
 	iterable, ok := args[0].(starlark.Iterable)
 	if !ok {
 		return nil, fmt.Errorf("argument is not iterable: %#v", args[0])
 	}
+	// read the values before taking the lock, since they may come from g.
+	var vals []reflect.Value
 	var val starlark.Value
 	it := iterable.Iterate()
-	defer it.Done()
 	for it.Next(&val) {
-		v := conv(val, g.v.Type().Elem())
-		g.v = reflect.Append(g.v, v)
+		vals = append(vals, conv(val, g.v.Type().Elem()))
 	}
+	it.Done()
 
+	defer lock(g.mu)()
+	if err := g.checkMutable("extend"); err != nil {
+		return nil, err
+	}
+	g.v = reflect.Append(g.v, vals...)
 	return starlark.None, nil
 }
 
@@ -263,6 +288,7 @@ func list_index(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starlar
 		// ok
 	}
 	value := conv(args[0], g.v.Type().Elem())
+	defer rlock(g.mu)()
 	start, end, err := indices(start_, end_, g.v.Len())
 	if err != nil {
 		return nil, fmt.Errorf("%s: %s", fnname, err)
@@ -281,20 +307,20 @@ func list_insert(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starla
 	if len(args) != 2 {
 		return nil, fmt.Errorf("extend: got %d arguments, want 2", len(args))
 	}
-	if err := g.checkMutable("insert into"); err != nil {
+	index, err := toInt(args[0])
+	if err != nil {
 		return nil, err
 	}
+	val := conv(args[1], g.v.Type().Elem())
 
-	index, err := toInt(args[0])
-	if err != nil {
+	defer lock(g.mu)()
+	if err := g.checkMutable("insert into"); err != nil {
 		return nil, err
 	}
 	if index < 0 {
 		index += g.v.Len()
 	}
-
-	val := conv(args[1], g.v.Type().Elem())
-	if index >= g.Len() {
+	if index >= g.v.Len() {
 		g.v = reflect.Append(g.v, val)
 	} else {
 		if index < 0 {
@@ -312,11 +338,12 @@ func list_remove(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starla
 	if len(args) != 1 {
 		return nil, fmt.Errorf("remove: got %d arguments, want 1", len(args))
 	}
+	v := conv(args[0], g.v.Type().Elem()).Interface()
+
+	defer lock(g.mu)()
 	if err := g.checkMutable("remove from"); err != nil {
 		return nil, err
 	}
-
-	v := conv(args[0], g.v.Type().Elem()).Interface()
 	for i := 0; i < g.v.Len(); i++ {
 		elem := g.v.Index(i)
 		if reflect.DeepEqual(elem.Interface(), v) {
@@ -329,6 +356,7 @@ func list_remove(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starla
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#list·pop
 func list_pop(fnname string, g *GoSlice, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	defer lock(g.mu)()
 	index := g.v.Len() - 1
 	switch len(args) {
 	case 0:
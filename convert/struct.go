@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 
 	"go.starlark.net/starlark"
 )
@@ -21,27 +22,34 @@ func NewStruct(strct interface{}) *GoStruct {
 // GoStruct is a wrapper around a Go struct to let it be manipulated by starlark
 // scripts.
 type GoStruct struct {
-	v reflect.Value
+	v      reflect.Value
+	frozen bool
+	mu     *sync.RWMutex
+	policy *Policy
 }
 
 // Attr returns a starlark value that wraps the method or field with the given
 // name.
 func (g *GoStruct) Attr(name string) (starlark.Value, error) {
+	if !g.policy.Allows(g.v.Type(), name) {
+		return nil, denied(g, name)
+	}
 	method := g.v.MethodByName(name)
 	if method.Kind() != reflect.Invalid {
-		return makeStarFn(name, method), nil
+		return methodValue(g, g.v, name, method, "struct")
 	}
 	v := g.v
 	if g.v.Kind() == reflect.Ptr {
 		v = v.Elem()
 		method = g.v.MethodByName(name)
 		if method.Kind() != reflect.Invalid {
-			return makeStarFn(name, method), nil
+			return methodValue(g, g.v, name, method, "struct")
 		}
 	}
+	defer rlock(g.mu)()
 	field := v.FieldByName(name)
 	if field.Kind() != reflect.Invalid {
-		return toValue(field)
+		return toChild(field, g)
 	}
 	return nil, nil
 }
@@ -72,11 +80,18 @@ func (g *GoStruct) AttrNames() []string {
 			names = append(names, g.v.Type().Field(i).Name)
 		}
 	}
-	return names
+	return filterNames(g.policy, g.v.Type(), names)
 }
 
 // SetField sets the struct field with the given name with the given value.
 func (g *GoStruct) SetField(name string, val starlark.Value) error {
+	if g.frozen {
+		return fmt.Errorf("cannot set field %s of frozen struct", name)
+	}
+	if !g.policy.Allows(g.v.Type(), name) {
+		return fmt.Errorf("cannot set field %s of %s: not allowed by policy", name, g.Type())
+	}
+	defer lock(g.mu)()
 	v := g.v
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
@@ -93,6 +108,7 @@ func (g *GoStruct) SetField(name string, val starlark.Value) error {
 // String returns the string representation of the value.
 // Starlark string values are quoted as if by Python's repr.
 func (g *GoStruct) String() string {
+	defer rlock(g.mu)()
 	return fmt.Sprint(g.v.Interface())
 }
 
@@ -107,7 +123,14 @@ func (g *GoStruct) Type() string {
 // structure through this API will fail dynamically, making the
 // data structure immutable and safe for publishing to other
 // Starlark interpreters running concurrently.
-func (g *GoStruct) Freeze() {}
+//
+// A frozen struct's fields can't be set, and its methods with pointer
+// receivers, which may change the struct, can't be called.  Fields and the
+// values returned by methods are frozen too.  Freezing only affects access
+// through this value; go code can still change the struct.
+func (g *GoStruct) Freeze() {
+	g.frozen = true
+}
 
 // Truth returns the truth value of an object.
 func (g *GoStruct) Truth() starlark.Bool {
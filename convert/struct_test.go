@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/starlight-go/starlight"
+	"github.com/starlight-go/starlight/convert"
 )
 
 type mega struct {
@@ -73,5 +74,78 @@ a = m.getBool()
 		"m": &mega{},
 	}
 	_, err := starlight.Eval(code, globals, nil)
-	expectErr(t, err, "starlight_struct<*convert_test.mega> has no .getBool field or method")
+	expectErr(t, err, "starlight_struct<*convert_test.mega> has no .getBool field or method (did you mean .Bool?)")
+}
+
+type settings struct {
+	Name    string
+	Tags    []string
+	Limits  map[string]int
+	Nested  *settings
+	counter int
+}
+
+func (s *settings) Bump() int {
+	s.counter++
+	return s.counter
+}
+
+func (s settings) Self() *settings {
+	return &s
+}
+
+func (s *settings) GetName() string {
+	return s.Name
+}
+
+func TestReadOnly(t *testing.T) {
+	s := &settings{
+		Name:   "prod",
+		Tags:   []string{"a"},
+		Limits: map[string]int{"cpu": 2},
+		Nested: &settings{Name: "inner"},
+	}
+	globals := map[string]interface{}{
+		"s":      convert.ReadOnly(s),
+		"assert": &assert{t: t},
+	}
+	code := []byte(`
+assert.Eq(s.Name, "prod")
+assert.Eq(s.Limits["cpu"], 2)
+assert.Eq(s.Nested.Name, "inner")
+assert.Eq(s.Self().Name, "prod")
+`)
+	if _, err := starlight.Eval(code, globals, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expectFails(t, []fail{
+		{code: `s.Name = "dev"`, err: "cannot set field Name of frozen struct"},
+		{code: `s.Nested.Name = "dev"`, err: "cannot set field Name of frozen struct"},
+		{code: `s.Self().Name = "dev"`, err: "cannot set field Name of frozen struct"},
+		{code: `s.Tags[0] = "b"`, err: "cannot assign to frozen slice"},
+		{code: `s.Tags.append("b")`, err: "cannot append to frozen slice"},
+		{code: `s.Limits["cpu"] = 4`, err: "cannot insert into frozen map"},
+		{code: `s.Bump()`, err: "cannot call Bump on frozen struct: it may modify the struct"},
+		{code: `s.GetName()`, err: "cannot call GetName on frozen struct: it may modify the struct"},
+	}, globals)
+
+	// a read rule lets scripts call getters with pointer receivers.
+	p := convert.NewPolicy().Read("*convert_test.settings", "Get*")
+	globals["s"] = convert.Restricted(convert.ReadOnly(s), p)
+	code = []byte(`
+assert.Eq(s.GetName(), "prod")
+assert.Eq(s.Nested.GetName(), "inner")
+`)
+	if _, err := starlight.Eval(code, globals, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectFails(t, []fail{
+		{code: `s.Bump()`, err: "cannot call Bump on frozen struct: it may modify the struct"},
+		{code: `s.Name = "dev"`, err: "cannot set field Name of frozen struct"},
+	}, globals)
+
+	if s.Name != "prod" || s.Nested.Name != "inner" || s.Tags[0] != "a" || s.Limits["cpu"] != 2 || s.counter != 0 {
+		t.Fatalf("read-only value was changed: %+v", s)
+	}
 }
@@ -0,0 +1,64 @@
+package convert
+
+import (
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Synchronized converts v as with ToValue, and makes every read and write of
+// the result, and of the values read from it, hold mu.  Reads hold the read
+// lock and writes hold the write lock, so scripts running at the same time on
+// different goroutines can share v safely.  Go code that uses v at the same
+// time as scripts should hold mu too.  If mu is nil, a new mutex is used.
+//
+// Methods of v are called with mu held: methods with pointer receivers hold
+// the write lock, and other methods hold the read lock.  Such methods must not
+// use v through its starlark value, or they will deadlock.  For the same
+// reason, scripts can't pass functions to the methods of v.
+//
+// Synchronized panics if v can't be converted.
+func Synchronized(v interface{}, mu *sync.RWMutex) starlark.Value {
+	if mu == nil {
+		mu = new(sync.RWMutex)
+	}
+	val, err := ToValue(v)
+	if err != nil {
+		panic(err)
+	}
+	setMutex(val, mu)
+	return val
+}
+
+// setMutex makes v, if it wraps a go value, hold mu while it's used.
+func setMutex(v starlark.Value, mu *sync.RWMutex) {
+	switch v := v.(type) {
+	case *GoStruct:
+		v.mu = mu
+	case *GoInterface:
+		v.mu = mu
+	case *GoMap:
+		v.mu = mu
+	case *GoSlice:
+		v.mu = mu
+	}
+}
+
+// rlock read-locks mu, if it isn't nil, and returns the function that unlocks
+// it, for use as defer rlock(mu)().
+func rlock(mu *sync.RWMutex) func() {
+	if mu == nil {
+		return func() {}
+	}
+	mu.RLock()
+	return mu.RUnlock
+}
+
+// lock is like rlock, but takes the write lock.
+func lock(mu *sync.RWMutex) func() {
+	if mu == nil {
+		return func() {}
+	}
+	mu.Lock()
+	return mu.Unlock
+}
@@ -0,0 +1,114 @@
+package convert_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/starlight-go/starlight"
+	"github.com/starlight-go/starlight/convert"
+)
+
+type counter struct {
+	Counts map[string]int
+	Names  []string
+	n      int
+}
+
+func (c *counter) Inc() int {
+	c.n++
+	return c.n
+}
+
+func TestSynchronized(t *testing.T) {
+	var mu sync.RWMutex
+	c := &counter{Counts: map[string]int{}, Names: []string{"a", "b"}}
+	globals := map[string]interface{}{
+		"c": convert.Synchronized(c, &mu),
+	}
+	code := []byte(`
+def run():
+	for i in range(100):
+		c.Counts[name] = c.Counts.get(name, 0) + 1
+		c.Counts["shared"] = i
+		c.Inc()
+		for n in c.Names:
+			pass
+		len(c.Counts)
+run()
+`)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g := map[string]interface{}{"name": fmt.Sprint(i)}
+			for k, v := range globals {
+				g[k] = v
+			}
+			_, err := starlight.Eval(code, g, nil)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for i := 0; i < 8; i++ {
+		if n := c.Counts[fmt.Sprint(i)]; n != 100 {
+			t.Errorf("expected count for %d to be 100, got %d", i, n)
+		}
+	}
+	if c.n != 800 {
+		t.Errorf("expected Inc to be called 800 times, got %d", c.n)
+	}
+}
+
+type box struct {
+	N int
+}
+
+func (b *box) Each(f func(int)) {
+	for i := 0; i < b.N; i++ {
+		f(i)
+	}
+}
+
+func (b box) Sum(f func(int) int) int {
+	sum := 0
+	for i := 0; i < b.N; i++ {
+		sum += f(i)
+	}
+	return sum
+}
+
+func TestSynchronizedCallbacks(t *testing.T) {
+	globals := map[string]interface{}{
+		"box":   convert.Synchronized(&box{N: 3}, nil),
+		"plain": &box{N: 3},
+	}
+	code := []byte(`
+seen = []
+plain.Each(lambda i: seen.append(i + plain.N))
+out = plain.Sum(lambda i: i)
+`)
+	out, err := starlight.Eval(code, globals, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out["out"] != int64(3) {
+		t.Fatalf("expected 3, got %v", out["out"])
+	}
+
+	tests := []fail{
+		{`box.Each(lambda i: box.N)`, "cannot pass a function to Each of synchronized struct: it would run with the struct locked"},
+		{`box.Sum(lambda i: box.N)`, "cannot pass a function to Sum of synchronized struct: it would run with the struct locked"},
+	}
+	expectFails(t, tests, globals)
+}
@@ -0,0 +1,129 @@
+package starlight
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// ScriptError is returned when a script fails to compile or run.  It records
+// where in the script the error happened.  Errors returned by go functions the
+// script called, and the errors wrapped by cancelled scripts (such as
+// context.Canceled and ErrTooManySteps), can be reached with errors.Is and
+// errors.As.
+type ScriptError struct {
+	// Filename is the name of the file the error happened in.
+	Filename string
+	// Line and Col are the 1-based position of the error in the file, or
+	// zero if the position is unknown.
+	Line, Col int
+	// Msg describes the error, without its position.
+	Msg string
+	// Backtrace is the starlark call stack at the time of the error.  It is
+	// empty for errors that happen while compiling the script.
+	Backtrace string
+	// Snippet is the line of source the error happened on, followed by a
+	// line with a caret under the column of the error.  It is empty if the
+	// source is not available.
+	Snippet string
+	// Err is the underlying error.
+	Err error
+
+	text string
+}
+
+// Error returns the same message as the starlark error the ScriptError was
+// made from.  Like starlark's own errors, that includes the position for
+// errors found while compiling the script, but not for errors that happen
+// while it runs.
+func (e *ScriptError) Error() string {
+	return e.text
+}
+
+// Unwrap returns the underlying error.
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// scriptError converts errors from compiling or running a script into a
+// *ScriptError that unwraps to cause.  Source returns the source of the file
+// with the given name, or nil if it's not available.  Errors that aren't from
+// starlark are returned as-is.
+func scriptError(err, cause error, source func(filename string) []byte) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ScriptError); ok {
+		return err
+	}
+	e := &ScriptError{Err: cause, text: err.Error()}
+	var pos syntax.Position
+	switch err := err.(type) {
+	case *starlark.EvalError:
+		e.Msg = err.Msg
+		e.Backtrace = err.Backtrace()
+		pos = innermost(err.CallStack)
+	case syntax.Error:
+		e.Msg = err.Msg
+		pos = err.Pos
+	case resolve.ErrorList:
+		if len(err) == 0 {
+			return err
+		}
+		e.Msg = err[0].Msg
+		if len(err) > 1 {
+			e.Msg += fmt.Sprintf(" (and %d more errors)", len(err)-1)
+		}
+		pos = err[0].Pos
+	default:
+		return err
+	}
+	e.Filename = pos.Filename()
+	e.Line, e.Col = int(pos.Line), int(pos.Col)
+	if e.Line > 0 && source != nil {
+		e.Snippet = snippet(source(e.Filename), e.Line, e.Col)
+	}
+	return e
+}
+
+// innermost returns the position of the innermost call frame that is in a
+// script rather than a builtin.
+func innermost(stack starlark.CallStack) syntax.Position {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].Pos.Filename() != "<builtin>" {
+			return stack[i].Pos
+		}
+	}
+	if len(stack) > 0 {
+		return stack[0].Pos
+	}
+	return syntax.Position{}
+}
+
+// snippet returns the given line of src, followed by a line with a caret
+// under the given column.
+func snippet(src []byte, line, col int) string {
+	lines := bytes.Split(src, []byte("\n"))
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	text := strings.TrimRight(string(lines[line-1]), "\r")
+	var caret strings.Builder
+	for i, r := range []rune(text) {
+		if i >= col-1 {
+			break
+		}
+		// keep tabs so the caret lines up however tabs are displayed.
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	caret.WriteRune('^')
+	return text + "\n" + caret.String()
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/starlight-go/starlight/convert"
+	"go.starlark.net/starlark"
+)
+
+// JSON returns the members of the json module:
+//
+//	encode(v)              returns v encoded as a JSON string
+//	encode_indent(v, ind)  like encode, but indents nested values with ind
+//	decode(s)              returns the value the JSON string s encodes
+//
+// JSON objects decode to dicts, arrays to lists, and whole numbers to ints.
+// Go values passed to scripts encode the same way encoding/json would encode
+// them.
+func JSON() map[string]interface{} {
+	return map[string]interface{}{
+		"encode":        jsonEncode,
+		"encode_indent": jsonEncodeIndent,
+		"decode":        jsonDecode,
+	}
+}
+
+func jsonEncode(v starlark.Value) (string, error) {
+	val, err := fromStarlark(v)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func jsonEncodeIndent(v starlark.Value, indent string) (string, error) {
+	val, err := fromStarlark(v)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(val, "", indent)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// fromStarlark converts a starlark value into a go value that encoding/json
+// can marshal.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		return json.Number(v.String()), nil
+	case starlark.Float:
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("json: cannot encode %v", v)
+		}
+		return f, nil
+	case starlark.IterableMapping:
+		if _, ok := v.(*convert.GoMap); ok {
+			break
+		}
+		m := make(map[string]interface{}, starlark.Len(v))
+		for _, item := range v.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("json: cannot encode dict with %s key", item[0].Type())
+			}
+			val, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[string(k)] = val
+		}
+		return m, nil
+	case *starlark.List, starlark.Tuple, *starlark.Set:
+		var vals []interface{}
+		it := starlark.Iterate(v)
+		defer it.Done()
+		var elem starlark.Value
+		for it.Next(&elem) {
+			val, err := fromStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		if vals == nil {
+			vals = []interface{}{}
+		}
+		return vals, nil
+	case starlark.Callable:
+		return nil, fmt.Errorf("json: cannot encode %s", v.Type())
+	}
+	return convert.FromValue(v), nil
+}
+
+func jsonDecode(s string) (starlark.Value, error) {
+	d := json.NewDecoder(bytes.NewReader([]byte(s)))
+	d.UseNumber()
+	v, err := decodeValue(d)
+	if err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("json: unexpected data after top-level value")
+	}
+	return v, nil
+}
+
+// decodeValue reads the next value from d and converts it into starlark
+// values.  It reads objects a key at a time, rather than into a go map, so
+// that dicts keep the order of the keys in the document.
+func decodeValue(d *json.Decoder) (starlark.Value, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(tok), nil
+	case string:
+		return starlark.String(tok), nil
+	case json.Number:
+		if i, err := tok.Int64(); err == nil {
+			return starlark.MakeInt64(i), nil
+		}
+		f, err := tok.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case json.Delim:
+		if tok == '[' {
+			var vals []starlark.Value
+			for d.More() {
+				val, err := decodeValue(d)
+				if err != nil {
+					return nil, err
+				}
+				vals = append(vals, val)
+			}
+			// the closing bracket.
+			if _, err := d.Token(); err != nil {
+				return nil, err
+			}
+			return starlark.NewList(vals), nil
+		}
+		dict := new(starlark.Dict)
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			val, err := decodeValue(d)
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.SetKey(starlark.String(key.(string)), val); err != nil {
+				return nil, err
+			}
+		}
+		// the closing brace.
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("json: unexpected %v", tok)
+}
@@ -0,0 +1,46 @@
+// Package lib provides a standard library of modules that starlight scripts
+// can load with load(), such as load("json", "encode", "decode").  The
+// modules are opt-in; register them with a Cache using Register.
+package lib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/starlight-go/starlight"
+)
+
+// Modules returns the members of every module in the library, keyed by the
+// name scripts load them with.
+func Modules() map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		"json":    JSON(),
+		"math":    Math(),
+		"re":      Re(),
+		"strings": Strings(),
+		"time":    Time(),
+	}
+}
+
+// Register registers the modules with the given names with the cache, so that
+// scripts run by the cache can load them.  If no names are given, every module
+// in the library is registered.
+func Register(c *starlight.Cache, names ...string) error {
+	modules := Modules()
+	if len(names) == 0 {
+		for name := range modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		members, ok := modules[name]
+		if !ok {
+			return fmt.Errorf("no library module named %q", name)
+		}
+		if err := c.RegisterModule(name, members); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package lib_test
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/starlight-go/starlight"
+	"github.com/starlight-go/starlight/lib"
+)
+
+func run(t *testing.T, code string, globals map[string]interface{}) map[string]interface{} {
+	v, err := runErr(t, code, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func runErr(t *testing.T, code string, globals map[string]interface{}) (map[string]interface{}, error) {
+	fsys := fstest.MapFS{"main.star": &fstest.MapFile{Data: []byte(code)}}
+	c, err := starlight.NewCache(starlight.WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	return c.Run("main.star", globals)
+}
+
+// expectErrs runs each script, and checks that it fails with the matching
+// error.
+func expectErrs(t *testing.T, tests map[string]string) {
+	for code, expected := range tests {
+		t.Run(code, func(t *testing.T) {
+			_, err := runErr(t, code, nil)
+			if err == nil || err.Error() != expected {
+				t.Fatalf("expected error %q, got %v", expected, err)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	v := run(t, `
+load("json", "encode", "decode")
+data = decode('{"name": "bob", "tags": ["a", "b"], "age": 42, "score": 1.5, "ok": true, "none": null}')
+name = data["name"]
+tags = len(data["tags"])
+age = data["age"] + 1
+score = data["score"]
+ok = data["ok"]
+none = data["none"] == None
+out = encode({"list": [1, "two", None], "nested": {"x": 1.5}})
+goval = encode(thing)
+keys = ",".join(decode('{"f": 1, "b": 2, "e": 3, "a": {"z": 1, "y": 2}, "d": 5, "c": 6}').keys())
+nested = ",".join(decode('[{"z": 1, "y": 2, "x": 3}]')[0].keys())
+`, map[string]interface{}{
+		"thing": struct{ Name string }{Name: "widget"},
+	})
+	expected := map[string]interface{}{
+		"name":  "bob",
+		"tags":  int64(2),
+		"age":   int64(43),
+		"score": 1.5,
+		"ok":    true,
+		"none":  true,
+		"out":   `{"list":[1,"two",null],"nested":{"x":1.5}}`,
+		"goval": `{"Name":"widget"}`,
+		// decoded dicts keep the order of the document's keys.
+		"keys":   "f,b,e,a,d,c",
+		"nested": "z,y,x",
+	}
+	for k, exp := range expected {
+		if v[k] != exp {
+			t.Errorf("%s: expected %#v but got %#v", k, exp, v[k])
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	when := time.Date(2018, 12, 7, 10, 30, 0, 0, time.UTC)
+	v := run(t, `
+load("time", "parse", "format", "add", "sub", "parse_duration", "seconds", "RFC3339")
+t = parse(RFC3339, "2018-12-07T12:00:00Z")
+elapsed = seconds(sub(t, when))
+later = format(add(when, parse_duration("1h")), "15:04")
+year = when.Year()
+`, map[string]interface{}{"when": when})
+	if v["elapsed"] != 5400.0 {
+		t.Errorf("expected 5400 seconds elapsed but got %v", v["elapsed"])
+	}
+	if v["later"] != "11:30" {
+		t.Errorf(`expected "11:30" but got %v`, v["later"])
+	}
+	if v["year"] != int64(2018) {
+		t.Errorf("expected 2018 but got %v", v["year"])
+	}
+	parsed, ok := v["t"].(time.Time)
+	if !ok || !parsed.Equal(time.Date(2018, 12, 7, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected t to be a time.Time at noon, but got %#v", v["t"])
+	}
+}
+
+func TestTimeArity(t *testing.T) {
+	expectErrs(t, map[string]string{
+		`load("time", "sub", "now")` + "\nsub(now())": "expected 2 args but got 1",
+		`load("time", "since")` + "\nsince()":         "expected 1 args but got 0",
+	})
+}
+
+func TestWrongTypes(t *testing.T) {
+	expectErrs(t, map[string]string{
+		`load("math", "sqrt")` + "\nsqrt(\"a\")":                 "sqrt: cannot decode argument 1: expected float (float64), but got starlark string",
+		`load("math", "sqrt")` + "\nsqrt(None)":                  "sqrt: cannot decode argument 1: expected float (float64), but got starlark NoneType",
+		`load("math", "pow")` + "\npow(2, [])":                   "pow: cannot decode argument 2: expected float (float64), but got starlark list",
+		`load("strings", "to_upper")` + "\nto_upper(65)":         "to_upper: cannot decode argument 1: expected string, but got starlark int",
+		`load("strings", "repeat")` + "\nrepeat(\"a\", \"b\")":   "repeat: cannot decode argument 2: expected int (int), but got starlark string",
+		`load("re", "match")` + "\nmatch(1, \"a\")":              "match: cannot decode argument 1: expected string, but got starlark int",
+		`load("re", "split")` + "\nsplit(\"a\", None)":           "split: cannot decode argument 2: expected string, but got starlark NoneType",
+		`load("time", "parse_duration")` + "\nparse_duration(1)": "parse_duration: cannot decode argument 1: expected string, but got starlark int",
+		`load("json", "decode")` + "\ndecode(1)":                 "decode: cannot decode argument 1: expected string, but got starlark int",
+	})
+}
+
+func TestRepeatLimit(t *testing.T) {
+	expectErrs(t, map[string]string{
+		`load("strings", "repeat")` + "\nrepeat(\"ab\", 4611686018427387904)": "repeat: result would be longer than 1048576 bytes",
+		`load("strings", "repeat")` + "\nrepeat(\"a\", 1048577)":              "repeat: result would be longer than 1048576 bytes",
+		`load("strings", "repeat")` + "\nrepeat(\"a\", -1)":                   "repeat: negative count -1",
+	})
+	v := run(t, `load("strings", "repeat")`+"\nn = len(repeat(\"a\", 1048576))\nempty = repeat(\"\", 4611686018427387904)", nil)
+	if v["n"] != int64(1048576) || v["empty"] != "" {
+		t.Errorf("expected a megabyte and an empty string, got %v and %q", v["n"], v["empty"])
+	}
+}
+
+func TestMathStringsRe(t *testing.T) {
+	v := run(t, `
+load("math", "sqrt", "floor", "pi")
+load("strings", "join", "split", "to_upper")
+load("re", "match", "find_all", "replace")
+root = sqrt(16)
+floored = floor(pi)
+joined = join("-", ["a", 1, True])
+parts = len(split("a,b,c", ","))
+upper = to_upper("hi")
+matched = match("^h.*o$", "hello")
+numbers = len(find_all("[0-9]+", "a1b22c333"))
+replaced = replace("(\\w+)@example.com", "bob@example.com", "$1")
+`, nil)
+	expected := map[string]interface{}{
+		"root":     4.0,
+		"floored":  3.0,
+		"joined":   "a-1-true",
+		"parts":    int64(3),
+		"upper":    "HI",
+		"matched":  true,
+		"numbers":  int64(3),
+		"replaced": "bob",
+	}
+	for k, exp := range expected {
+		if v[k] != exp {
+			t.Errorf("%s: expected %#v but got %#v", k, exp, v[k])
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"math"
+)
+
+// Math returns the members of the math module, which wraps the go math
+// package:
+//
+//	sqrt(x), pow(x, y), exp(x), log(x), log10(x), log2(x)
+//	floor(x), ceil(x), round(x), trunc(x), abs(x)
+//	sin(x), cos(x), tan(x), asin(x), acos(x), atan(x), atan2(y, x)
+//	is_inf(x), is_nan(x)
+//	pi, e, inf, nan
+//
+// Arguments may be ints or floats, and results are floats.
+func Math() map[string]interface{} {
+	return map[string]interface{}{
+		"sqrt":  math.Sqrt,
+		"pow":   math.Pow,
+		"exp":   math.Exp,
+		"log":   math.Log,
+		"log10": math.Log10,
+		"log2":  math.Log2,
+		"floor": math.Floor,
+		"ceil":  math.Ceil,
+		"round": math.Round,
+		"trunc": math.Trunc,
+		"abs":   math.Abs,
+		"sin":   math.Sin,
+		"cos":   math.Cos,
+		"tan":   math.Tan,
+		"asin":  math.Asin,
+		"acos":  math.Acos,
+		"atan":  math.Atan,
+		"atan2": math.Atan2,
+
+		"is_inf": mathIsInf,
+		"is_nan": math.IsNaN,
+
+		"pi":  math.Pi,
+		"e":   math.E,
+		"inf": math.Inf(1),
+		"nan": math.NaN(),
+	}
+}
+
+func mathIsInf(x float64) bool {
+	return math.IsInf(x, 0)
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"regexp"
+)
+
+// Re returns the members of the re module, which matches strings against
+// regular expressions with go regexp syntax:
+//
+//	match(pattern, s)           reports whether s contains a match of pattern
+//	find(pattern, s)            returns the first match in s, or ""
+//	find_all(pattern, s)        returns all matches in s
+//	find_submatch(pattern, s)   returns the first match and its groups
+//	replace(pattern, s, repl)   replaces all matches in s with repl, which may
+//	                            refer to groups as $1 or ${name}
+//	split(pattern, s)           splits s around all matches
+//	quote(s)                    escapes the special characters in s
+func Re() map[string]interface{} {
+	return map[string]interface{}{
+		"match":         regexp.MatchString,
+		"find":          reFind,
+		"find_all":      reFindAll,
+		"find_submatch": reFindSubmatch,
+		"replace":       reReplace,
+		"split":         reSplit,
+		"quote":         regexp.QuoteMeta,
+	}
+}
+
+func reFind(pattern, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.FindString(s), nil
+}
+
+func reFindAll(pattern, s string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.FindAllString(s, -1), nil
+}
+
+func reFindSubmatch(pattern, s string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.FindStringSubmatch(s), nil
+}
+
+func reReplace(pattern, s, repl string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+func reSplit(pattern, s string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.Split(s, -1), nil
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Strings returns the members of the strings module, which wraps the go
+// strings package:
+//
+//	join(sep, items)          joins the items, converted to strings, with sep
+//	split(s, sep)             splits s around each instance of sep
+//	fields(s)                 splits s around runs of whitespace
+//	replace(s, old, new)      replaces every instance of old in s with new
+//	contains(s, substr), has_prefix(s, prefix), has_suffix(s, suffix)
+//	index(s, substr)          returns the index of substr in s, or -1
+//	to_upper(s), to_lower(s), trim_space(s), trim(s, cutset)
+//	trim_prefix(s, prefix), trim_suffix(s, suffix)
+//	repeat(s, count), equal_fold(s, t)
+//
+// Repeat fails if the result would be longer than a megabyte.
+func Strings() map[string]interface{} {
+	return map[string]interface{}{
+		"join":        stringsJoin,
+		"split":       strings.Split,
+		"fields":      strings.Fields,
+		"replace":     stringsReplace,
+		"contains":    strings.Contains,
+		"has_prefix":  strings.HasPrefix,
+		"has_suffix":  strings.HasSuffix,
+		"index":       strings.Index,
+		"to_upper":    strings.ToUpper,
+		"to_lower":    strings.ToLower,
+		"trim_space":  strings.TrimSpace,
+		"trim":        strings.Trim,
+		"trim_prefix": strings.TrimPrefix,
+		"trim_suffix": strings.TrimSuffix,
+		"repeat":      stringsRepeat,
+		"equal_fold":  strings.EqualFold,
+	}
+}
+
+// stringsJoin accepts any list, tuple or go slice, since those don't all
+// convert to the same go type.
+func stringsJoin(sep string, items interface{}) (string, error) {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected a list of items, but got %T", items)
+	}
+	strs := make([]string, v.Len())
+	for i := range strs {
+		strs[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(strs, sep), nil
+}
+
+func stringsReplace(s, old, new string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// maxRepeatLen is the length of the longest string repeat makes, so that
+// scripts can't make the program allocate as much memory as they like.
+const maxRepeatLen = 1 << 20
+
+func stringsRepeat(s string, count int) (string, error) {
+	if count < 0 {
+		return "", fmt.Errorf("repeat: negative count %d", count)
+	}
+	// dividing, rather than multiplying, can't overflow.
+	if len(s) > 0 && count > maxRepeatLen/len(s) {
+		return "", fmt.Errorf("repeat: result would be longer than %d bytes", maxRepeatLen)
+	}
+	return strings.Repeat(s, count), nil
+}
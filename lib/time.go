@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"time"
+)
+
+// Time returns the members of the time module.  Times are go time.Time values,
+// so they work with time.Time values passed to scripts as globals, and scripts
+// can call their methods, such as t.Format(layout) and t.Year().
+//
+//	now()                   returns the current time
+//	unix(sec)               returns the time sec seconds after the Unix epoch
+//	parse(layout, value)    parses value using the go time layout
+//	format(t, layout)       formats t using the go time layout
+//	parse_duration(s)       parses a go duration string, such as "1h30m"
+//	since(t)                returns the duration since t
+//	add(t, d)               returns t plus the duration d
+//	sub(t, u)               returns the duration t minus u
+//	seconds(d)              returns the duration d as a float number of seconds
+//
+// The module also provides the common go layouts, such as RFC3339.
+func Time() map[string]interface{} {
+	return map[string]interface{}{
+		"now":            time.Now,
+		"unix":           timeUnix,
+		"parse":          time.Parse,
+		"format":         timeFormat,
+		"parse_duration": time.ParseDuration,
+		"since":          time.Since,
+		"add":            timeAdd,
+		"sub":            timeSub,
+		"seconds":        timeSeconds,
+
+		"ANSIC":       time.ANSIC,
+		"Kitchen":     time.Kitchen,
+		"RFC1123":     time.RFC1123,
+		"RFC1123Z":    time.RFC1123Z,
+		"RFC3339":     time.RFC3339,
+		"RFC3339Nano": time.RFC3339Nano,
+		"RFC822":      time.RFC822,
+		"RFC822Z":     time.RFC822Z,
+		"UnixDate":    time.UnixDate,
+	}
+}
+
+func timeUnix(sec int64) time.Time {
+	return time.Unix(sec, 0)
+}
+
+func timeFormat(t time.Time, layout string) string {
+	return t.Format(layout)
+}
+
+func timeAdd(t time.Time, d time.Duration) time.Time {
+	return t.Add(d)
+}
+
+func timeSub(t, u time.Time) time.Duration {
+	return t.Sub(u)
+}
+
+func timeSeconds(d time.Duration) float64 {
+	return d.Seconds()
+}
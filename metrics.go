@@ -0,0 +1,205 @@
+package starlight
+
+import (
+	"sync"
+	"time"
+)
+
+// CacheName names one of the caches a Cache keeps, for Observer.
+type CacheName string
+
+const (
+	// ScriptCache is the cache of compiled scripts run with Run and its
+	// variants.
+	ScriptCache CacheName = "scripts"
+	// ModuleCache is the cache of modules loaded with load() or Call.
+	ModuleCache CacheName = "modules"
+)
+
+// Observer is told what a Cache is doing, so it can be monitored.  Set one with
+// WithObserver.  Its methods may be called from many goroutines at once, and
+// are called synchronously, so they should be quick.
+type Observer interface {
+	// Compiled is called after a script is compiled, with the time it took
+	// and the error, if compiling failed.
+	Compiled(filename string, dur time.Duration, err error)
+	// CacheLookup is called each time a script or module is looked up in one
+	// of the cache's caches, with whether it was found.
+	CacheLookup(cache CacheName, filename string, hit bool)
+	// LoadCycle is called when loading a module fails because it loads itself,
+	// directly or indirectly.
+	LoadCycle(filename string)
+	// RunStarted is called when a script starts running with Run or one of
+	// its variants, or when a function is called with Call.
+	RunStarted(filename string)
+	// RunFinished is called when a run that RunStarted reported finishes,
+	// with the time it took and the error, if it failed.
+	RunFinished(filename string, dur time.Duration, err error)
+}
+
+// nopObserver is the Observer used when none is set.
+type nopObserver struct{}
+
+func (nopObserver) Compiled(string, time.Duration, error)    {}
+func (nopObserver) CacheLookup(CacheName, string, bool)      {}
+func (nopObserver) LoadCycle(string)                         {}
+func (nopObserver) RunStarted(string)                        {}
+func (nopObserver) RunFinished(string, time.Duration, error) {}
+
+// DefaultBuckets are the upper bounds of the buckets of the histograms kept by
+// Metrics, unless NewMetrics is given others.
+var DefaultBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Metrics is an Observer that counts what a Cache does, and keeps histograms
+// of how long compiling and running scripts takes.  Use Snapshot to read the
+// numbers, e.g. to expose them from a metrics endpoint.  The zero Metrics is
+// ready to use, and its histograms use DefaultBuckets.
+type Metrics struct {
+	mu   sync.Mutex
+	snap MetricsSnapshot
+}
+
+// NewMetrics returns a new Metrics whose histograms use the given bucket upper
+// bounds, which must be sorted.  If no buckets are given, DefaultBuckets are
+// used.
+func NewMetrics(buckets ...time.Duration) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	return &Metrics{snap: MetricsSnapshot{
+		CompileTime: newHistogram(buckets),
+		RunTime:     newHistogram(buckets),
+	}}
+}
+
+// MetricsSnapshot holds the numbers Metrics has counted so far.
+type MetricsSnapshot struct {
+	Compiles      uint64
+	CompileErrors uint64
+	CompileTime   Histogram
+
+	ScriptHits   uint64
+	ScriptMisses uint64
+	ModuleHits   uint64
+	ModuleMisses uint64
+
+	LoadCycles uint64
+
+	Runs      uint64
+	RunErrors uint64
+	// Running is the number of runs in progress.
+	Running int64
+	RunTime Histogram
+}
+
+// Histogram counts durations in buckets.
+type Histogram struct {
+	// Bounds are the upper bounds, inclusive, of each bucket but the last.
+	Bounds []time.Duration
+	// Counts are the number of durations in each bucket.  It has one more
+	// element than Bounds, for durations longer than every bound.
+	Counts []uint64
+	// Count and Sum are the number and total of all durations.
+	Count uint64
+	Sum   time.Duration
+}
+
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{
+		Bounds: append([]time.Duration(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		// the histogram of a zero Metrics.
+		*h = newHistogram(DefaultBuckets)
+	}
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h Histogram) clone() Histogram {
+	h.Bounds = append([]time.Duration(nil), h.Bounds...)
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// Snapshot returns a copy of the numbers counted so far.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := m.snap
+	snap.CompileTime = snap.CompileTime.clone()
+	snap.RunTime = snap.RunTime.clone()
+	return snap
+}
+
+// Compiled implements Observer.
+func (m *Metrics) Compiled(filename string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.Compiles++
+	if err != nil {
+		m.snap.CompileErrors++
+	}
+	m.snap.CompileTime.observe(dur)
+}
+
+// CacheLookup implements Observer.
+func (m *Metrics) CacheLookup(cache CacheName, filename string, hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case cache == ScriptCache && hit:
+		m.snap.ScriptHits++
+	case cache == ScriptCache:
+		m.snap.ScriptMisses++
+	case hit:
+		m.snap.ModuleHits++
+	default:
+		m.snap.ModuleMisses++
+	}
+}
+
+// LoadCycle implements Observer.
+func (m *Metrics) LoadCycle(filename string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.LoadCycles++
+}
+
+// RunStarted implements Observer.
+func (m *Metrics) RunStarted(filename string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.Running++
+}
+
+// RunFinished implements Observer.
+func (m *Metrics) RunFinished(filename string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.Running--
+	m.snap.Runs++
+	if err != nil {
+		m.snap.RunErrors++
+	}
+	m.snap.RunTime.observe(dur)
+}
@@ -0,0 +1,290 @@
+package starlight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/starlight-go/starlight/convert"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Option configures how scripts are run.  Options may be passed to
+// EvalOptions and Cache.RunOptions to configure a single run, or to NewCache
+// to set the defaults for every script the cache runs.  Options that don't
+// apply to a particular call are ignored.
+type Option func(*config)
+
+// config is the set of values an Option can change.
+type config struct {
+	ctx      context.Context
+	load     LoadFunc
+	filename string
+	print    func(thread *starlark.Thread, msg string)
+	name     string
+	limits   Limits
+	usage    *Usage
+	sources  []Source
+	ns       map[string][]Source
+	globals  map[string]interface{}
+	reload   bool
+	dialect  syntax.FileOptions
+	locals   map[string]interface{}
+	observer Observer
+
+	interceptor convert.Interceptor
+	policy      *convert.Policy
+
+	compileDir string
+
+	// source returns the source of a script, for quoting in errors.
+	source func(filename string) []byte
+}
+
+func makeConfig(opts []Option) config {
+	cfg := config{
+		ctx:      context.Background(),
+		filename: "eval.sky",
+		dialect:  defaultDialect,
+	}
+	cfg.apply(opts)
+	return cfg
+}
+
+func (cfg *config) apply(opts []Option) {
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+}
+
+// WithContext makes the script stop if ctx is done before the script
+// finishes.  In that case the returned error wraps ctx.Err().  Go functions
+// called by the script whose first parameter is a context.Context receive ctx.
+func WithContext(ctx context.Context) Option {
+	return func(cfg *config) {
+		cfg.ctx = ctx
+	}
+}
+
+// WithLoad sets the function scripts use to load other scripts with the load()
+// function.  It is ignored by Cache, which loads scripts from its own
+// directories.
+func WithLoad(load LoadFunc) Option {
+	return func(cfg *config) {
+		cfg.load = load
+	}
+}
+
+// WithFilename sets the filename reported in errors for scripts passed to
+// EvalOptions as a []byte or io.Reader.  The default is "eval.sky".
+func WithFilename(filename string) Option {
+	return func(cfg *config) {
+		cfg.filename = filename
+	}
+}
+
+// WithPrint sets the function called when a script calls print().  If no print
+// function is set, Eval writes to stderr and modules loaded by a Cache write
+// to stdout.  The print function also receives the output of modules the
+// script loads with load(), if they are loaded for the first time by this run.
+func WithPrint(print func(thread *starlark.Thread, msg string)) Option {
+	return func(cfg *config) {
+		cfg.print = print
+	}
+}
+
+// PrintFunc is called when a script calls print().  The filename is the name
+// of the file containing the print() call.
+type PrintFunc func(thread *starlark.Thread, filename, msg string)
+
+// WithPrintFunc is like WithPrint, but also passes the name of the file that
+// called print() to fn, which distinguishes the script's output from that of
+// the modules it loads.
+func WithPrintFunc(fn PrintFunc) Option {
+	return WithPrint(func(thread *starlark.Thread, msg string) {
+		fn(thread, callerFilename(thread), msg)
+	})
+}
+
+// WithOutput is like WithPrint, but writes each printed message to w, followed
+// by a newline.  Writes to w are not synchronized.
+func WithOutput(w io.Writer) Option {
+	return WithPrint(func(_ *starlark.Thread, msg string) {
+		fmt.Fprintln(w, msg)
+	})
+}
+
+// callerFilename returns the name of the file that called the builtin
+// currently running on thread.
+func callerFilename(thread *starlark.Thread) string {
+	if thread.CallStackDepth() < 2 {
+		return ""
+	}
+	return thread.CallFrame(1).Pos.Filename()
+}
+
+// WithLocal sets a thread-local value on the starlark thread the script runs
+// on, which go functions called by the script can get with thread.Local(key),
+// if their first parameter is a *starlark.Thread.  It's useful for passing
+// per-run values, such as the ID of the user the script runs for, to shared
+// functions.  Modules loaded with load() by a Cache run on their own threads,
+// since they're shared between runs, so they don't see the value.
+func WithLocal(key string, value interface{}) Option {
+	return func(cfg *config) {
+		locals := make(map[string]interface{}, len(cfg.locals)+1)
+		for k, v := range cfg.locals {
+			locals[k] = v
+		}
+		locals[key] = value
+		cfg.locals = locals
+	}
+}
+
+// WithInterceptor makes every call the script makes to a go function or
+// method go through ic, which can record the call and its results, or veto it.
+// See convert.Interceptor.  When passed to NewCache, it also applies to the
+// top level of modules loaded with load(); functions defined by modules run on
+// the thread of the script that calls them, so they use its interceptor.
+func WithInterceptor(ic convert.Interceptor) Option {
+	return func(cfg *config) {
+		cfg.interceptor = ic
+	}
+}
+
+// WithPolicy makes p decide which fields and methods of go values the script
+// can reach.  It applies to the globals passed to the script, the values go
+// functions return, and everything read from them.  See convert.Policy.  When
+// passed to NewCache, it also applies to the module globals, to modules
+// registered with RegisterModule, and to the top level of modules loaded with
+// load().
+func WithPolicy(p *convert.Policy) Option {
+	return func(cfg *config) {
+		cfg.policy = p
+	}
+}
+
+// WithThreadName sets the name of the starlark thread the script runs on.
+func WithThreadName(name string) Option {
+	return func(cfg *config) {
+		cfg.name = name
+	}
+}
+
+// WithLimits stops the script if it exceeds the given limits.  When passed to
+// NewCache, the limits also apply to modules loaded with load().
+func WithLimits(limits Limits) Option {
+	return func(cfg *config) {
+		cfg.limits = limits
+	}
+}
+
+// WithUsage reports the resources the script used to *usage when the script
+// finishes, even if the script fails.
+func WithUsage(usage *Usage) Option {
+	return func(cfg *config) {
+		cfg.usage = usage
+	}
+}
+
+// WithDirs adds directories for a Cache to search, in order, for scripts to
+// run and for modules loaded with load().  It is the same as WithSources with
+// a Dir for each directory.  It only applies to NewCache.
+func WithDirs(dirs ...string) Option {
+	return func(cfg *config) {
+		for _, d := range dirs {
+			cfg.sources = append(cfg.sources, Dir(d))
+		}
+	}
+}
+
+// WithSources adds sources for a Cache to search, in order, for scripts to run
+// and for modules loaded with load().  It only applies to NewCache.
+func WithSources(sources ...Source) Option {
+	return func(cfg *config) {
+		cfg.sources = append(cfg.sources, sources...)
+	}
+}
+
+// WithNamespace adds sources for a Cache to search, in order, for scripts
+// loaded with names like "@name//path/to/script.star".  Namespaces let groups
+// of scripts share modules without clashing with each other's file names.  It
+// only applies to NewCache.
+func WithNamespace(name string, sources ...Source) Option {
+	return func(cfg *config) {
+		if cfg.ns == nil {
+			cfg.ns = map[string][]Source{}
+		}
+		cfg.ns[name] = append(cfg.ns[name], sources...)
+	}
+}
+
+// WithFS is the same as WithSources with an FS source for each fsys.  It only
+// applies to NewCache.
+func WithFS(fsys ...fs.FS) Option {
+	return func(cfg *config) {
+		for _, f := range fsys {
+			cfg.sources = append(cfg.sources, FS(f))
+		}
+	}
+}
+
+// WithModuleGlobals sets the global values passed to scripts loaded with the
+// load() script function.  The values are shared by every module, so they are
+// frozen, and scripts can read them but not change them.  It only applies to
+// NewCache.
+func WithModuleGlobals(globals map[string]interface{}) Option {
+	return func(cfg *config) {
+		cfg.globals = globals
+	}
+}
+
+// WithAutoReload makes a Cache check whether a script's file has changed on
+// disk each time before it reuses the compiled script, and recompile it if it
+// has.  It also makes the cache retry loading modules that failed to load,
+// instead of remembering the failure.  It only applies to NewCache.
+func WithAutoReload() Option {
+	return func(cfg *config) {
+		cfg.reload = true
+	}
+}
+
+// defaultDialect allows the set() built-in, but not while loops, recursion,
+// top-level control statements or reassigning globals.
+var defaultDialect = syntax.FileOptions{Set: true}
+
+// WithDialect sets the starlark language features scripts may use, such as
+// while loops and recursion, which may be fine for trusted scripts but not for
+// untrusted ones.  By default, scripts may use the set() built-in, but not
+// while loops, recursion, if and for statements outside of functions, or
+// reassigning global variables.  When passed to NewCache, it applies to every script the
+// cache compiles, including modules loaded with load(), and it can't be
+// changed per run, since compiled scripts are shared between runs.
+func WithDialect(dialect syntax.FileOptions) Option {
+	return func(cfg *config) {
+		cfg.dialect = dialect
+	}
+}
+
+// WithObserver makes a Cache tell o what it's doing, such as compiling
+// scripts, looking them up in its caches and running them.  See Metrics for an
+// Observer that keeps counts.  It only applies to NewCache.
+func WithObserver(o Observer) Option {
+	return func(cfg *config) {
+		cfg.observer = o
+	}
+}
+
+// WithCompileCache makes a Cache store the compiled form of each script in
+// dir, and reuse it in later processes instead of parsing and compiling the
+// script again.  Compiled scripts are keyed by their filename, contents,
+// predeclared globals, dialect and the version of the starlark interpreter, so
+// stale entries are never used.  It only applies to NewCache.
+func WithCompileCache(dir string) Option {
+	return func(cfg *config) {
+		cfg.compileDir = dir
+	}
+}
@@ -0,0 +1,122 @@
+package starlight
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// stamp identifies the version of a file that a cached script was read from.
+type stamp struct {
+	src     Source
+	name    string
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte // only used if src is not a StatSource
+}
+
+// makeStamp returns the stamp for the file with the given name and contents,
+// read from src.
+func makeStamp(src Source, name string, b []byte) stamp {
+	s := stamp{src: src, name: name}
+	if st, ok := src.(StatSource); ok {
+		if fi, err := st.Stat(name); err == nil {
+			s.modTime = fi.ModTime()
+			s.size = fi.Size()
+			return s
+		}
+	}
+	s.hash = sha256.Sum256(b)
+	return s
+}
+
+// changed reports whether the file s was made from has been modified or
+// removed since then.
+func (s stamp) changed() bool {
+	if s.src == nil {
+		return false
+	}
+	if st, ok := s.src.(StatSource); ok {
+		fi, err := st.Stat(s.name)
+		if err != nil {
+			return true
+		}
+		if s.hash == ([sha256.Size]byte{}) {
+			return !fi.ModTime().Equal(s.modTime) || fi.Size() != s.size
+		}
+	}
+	b, err := s.src.ReadFile(s.name)
+	if err != nil {
+		return true
+	}
+	return sha256.Sum256(b) != s.hash
+}
+
+// OnReload registers fn to be called with the filename of each cached script
+// that is dropped from the cache because its file changed on disk, or because
+// it failed to load, either when it is next run with WithAutoReload set, or
+// when it is found by Watch.  The script is recompiled the next time it is run
+// or loaded.
+func (c *Cache) OnReload(fn func(filename string)) {
+	c.listenMu.Lock()
+	c.listeners = append(c.listeners, fn)
+	c.listenMu.Unlock()
+}
+
+// notifyReload calls the functions registered with OnReload.
+func (c *Cache) notifyReload(filename string) {
+	c.listenMu.Lock()
+	listeners := c.listeners
+	c.listenMu.Unlock()
+	for _, fn := range listeners {
+		fn(filename)
+	}
+}
+
+// Watch starts polling the files of cached scripts every interval, and
+// forgets any whose files have changed on disk, so they will be recompiled the
+// next time they are run or loaded.  It also forgets modules that failed to
+// load, so that loading them again retries them.  Call the returned function
+// to stop watching; calling it more than once does nothing.
+func (c *Cache) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.reloadChanged()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// reloadChanged forgets every cached script whose file has changed, and every
+// module that failed to load.
+func (c *Cache) reloadChanged() {
+	stamps := map[string]stamp{}
+	c.mu.Lock()
+	for filename, s := range c.stamps {
+		stamps[filename] = s
+	}
+	c.mu.Unlock()
+	modules, failed := c.cache.stamps()
+	for filename, s := range modules {
+		stamps[filename] = s
+	}
+	for _, filename := range failed {
+		c.Forget(filename)
+		c.notifyReload(filename)
+	}
+	for filename, s := range stamps {
+		if s.changed() {
+			c.Forget(filename)
+			c.notifyReload(filename)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package starlight
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Module names passed to load() are resolved to a canonical name before they
+// are looked up, and scripts are cached under their canonical name:
+//
+//	util.star         relative to the root of the cache's sources
+//	//lib/util.star   also relative to the root of the cache's sources
+//	./util.star       relative to the directory of the script calling load()
+//	../util.star      likewise
+//	@shared//x.star   relative to the root of the sources of the namespace
+//	                  named "shared", given with WithNamespace
+//
+// Canonical names are slash-separated, with no leading slash, and start with
+// "@name//" for scripts in a namespace.  Filenames passed to Cache.Run and
+// Cache.Call are resolved the same way, relative to the root of the sources.
+// Names that are absolute, or that lead outside the sources with "..", are
+// rejected, whether they're passed to load() or to Run.
+
+// resolve returns the canonical name of module, as loaded by the script with
+// the canonical name from.  If from is empty, relative names are relative to
+// the root of the cache's sources.
+func (c *Cache) resolve(from, module string) (string, error) {
+	ns, name := "", module
+	switch {
+	case strings.HasPrefix(module, "@"):
+		i := strings.Index(module, "//")
+		if i < 0 {
+			return "", fmt.Errorf("invalid module name %q: namespaced names look like @name//path", module)
+		}
+		ns, name = module[1:i], module[i+2:]
+		if _, ok := c.namespaces[ns]; !ok {
+			return "", fmt.Errorf("invalid module name %q: unknown namespace %q", module, ns)
+		}
+	case strings.HasPrefix(module, "//"):
+		name = module[2:]
+	case strings.HasPrefix(module, "./"), strings.HasPrefix(module, "../"):
+		var dir string
+		ns, dir = splitNamespace(from)
+		name = path.Join(path.Dir(dir), module)
+	}
+	name = path.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("invalid module name %q: must be a file within the configured sources", module)
+	}
+	if ns != "" {
+		return "@" + ns + "//" + name, nil
+	}
+	return name, nil
+}
+
+// splitNamespace splits a canonical name into its namespace, which is empty
+// for names that aren't in a namespace, and its path within the namespace.
+func splitNamespace(name string) (ns, rest string) {
+	if !strings.HasPrefix(name, "@") {
+		return "", name
+	}
+	i := strings.Index(name, "//")
+	if i < 0 {
+		return "", name
+	}
+	return name[1:i], name[i+2:]
+}
@@ -0,0 +1,126 @@
+package starlight
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Source is a place a Cache reads scripts from.
+type Source interface {
+	// ReadFile returns the contents of the script with the given name.  It
+	// returns an error if the script doesn't exist.
+	ReadFile(name string) ([]byte, error)
+}
+
+// StatSource is a Source that can also report information about a script
+// without reading it.  A Cache uses the modification time and size to notice
+// changed scripts; for other sources it compares the scripts' contents.
+type StatSource interface {
+	Source
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// ListSource is a Source that can also list the scripts it has, so that
+// Cache.Check and Cache.Preload can find them.
+type ListSource interface {
+	Source
+	// List returns the slash-separated names of the scripts in the source,
+	// relative to its root.
+	List() ([]string, error)
+}
+
+// Dir returns a Source that reads scripts from the given directory on disk.
+func Dir(dir string) Source {
+	return dirSource(dir)
+}
+
+type dirSource string
+
+func (d dirSource) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirSource) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+func (d dirSource) List() ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(string(d), func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || !isScript(path) {
+			return err
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
+
+func (d dirSource) String() string {
+	return string(d)
+}
+
+// FS returns a Source that reads scripts from fsys, such as an embed.FS or an
+// fstest.MapFS.  Script names must be valid fs.FS paths.
+func FS(fsys fs.FS) Source {
+	return fsSource{fsys}
+}
+
+type fsSource struct {
+	fsys fs.FS
+}
+
+func (s fsSource) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(s.fsys, name)
+}
+
+func (s fsSource) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, name)
+}
+
+func (s fsSource) List() ([]string, error) {
+	var names []string
+	err := fs.WalkDir(s.fsys, ".", func(path string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || !isScript(path) {
+			return err
+		}
+		names = append(names, path)
+		return nil
+	})
+	return names, err
+}
+
+func (s fsSource) String() string {
+	return fmt.Sprintf("%T", s.fsys)
+}
+
+// SourceFunc is a Source that calls the function to read a script, which is
+// useful for loading scripts from a database or other custom storage.
+type SourceFunc func(name string) ([]byte, error)
+
+// ReadFile calls f(name).
+func (f SourceFunc) ReadFile(name string) ([]byte, error) {
+	return f(name)
+}
+
+// isScript reports whether the file with the given name is a starlark script,
+// judging by its extension.
+func isScript(name string) bool {
+	return strings.HasSuffix(name, ".star")
+}
+
+// sourceName describes src for error messages.
+func sourceName(src Source) string {
+	if s, ok := src.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", src)
+}
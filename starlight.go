@@ -2,69 +2,198 @@
 package starlight
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/starlight-go/starlight/convert"
-	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
 )
 
-func init() {
-	resolve.AllowNestedDef = true // allow def statements within function bodies
-	resolve.AllowLambda = true    // allow lambda expressions
-	resolve.AllowFloat = true     // allow floating point literals, the 'float' built-in, and x / y
-	resolve.AllowSet = true       // allow the 'set' built-in
-	resolve.AllowBitwise = true   // allow bitwise operations
-}
-
 // LoadFunc is a function that tells starlark how to find and load other scripts
 // using the load() function.  If you don't use load() in your scripts, you can pass in nil.
 type LoadFunc func(thread *starlark.Thread, module string) (starlark.StringDict, error)
 
+// Limits restricts the resources a script may use while it runs.
+type Limits struct {
+	// MaxSteps is the maximum number of execution steps a script may take
+	// before it is stopped.  Zero means no limit.
+	MaxSteps uint64
+}
+
+// Usage reports the resources a script used while it ran.
+type Usage struct {
+	// Steps is the number of execution steps the script took.
+	Steps uint64
+}
+
+// ErrTooManySteps is wrapped by the error returned when a script is stopped
+// for exceeding Limits.MaxSteps.
+var ErrTooManySteps = errors.New("too many execution steps")
+
 // Eval evaluates the starlark source with the given global variables. The type
 // of the argument for the src parameter must be string (filename), []byte, or io.Reader.
 func Eval(src interface{}, globals map[string]interface{}, load LoadFunc) (map[string]interface{}, error) {
+	return EvalOptions(src, globals, WithLoad(load))
+}
+
+// EvalContext is like Eval, but stops the script if ctx is done before the
+// script finishes.  In that case the returned error wraps ctx.Err().
+func EvalContext(ctx context.Context, src interface{}, globals map[string]interface{}, load LoadFunc) (map[string]interface{}, error) {
+	return EvalOptions(src, globals, WithContext(ctx), WithLoad(load))
+}
+
+// EvalLimits is like EvalContext, but stops the script if it exceeds the
+// given limits, and reports the resources the script used.  The usage is
+// reported even if the script fails.
+func EvalLimits(ctx context.Context, src interface{}, globals map[string]interface{}, load LoadFunc, limits Limits) (map[string]interface{}, Usage, error) {
+	var usage Usage
+	ret, err := EvalOptions(src, globals, WithContext(ctx), WithLoad(load), WithLimits(limits), WithUsage(&usage))
+	return ret, usage, err
+}
+
+// EvalOptions evaluates the starlark source with the given global variables,
+// configured by the given options. The type of the argument for the src
+// parameter must be string (filename), []byte, or io.Reader.
+func EvalOptions(src interface{}, globals map[string]interface{}, opts ...Option) (map[string]interface{}, error) {
+	dict, err := evalDict(src, globals, opts)
+	if err != nil {
+		return nil, err
+	}
+	return convert.FromStringDict(dict), nil
+}
+
+// EvalInto is like EvalOptions, but fills the fields of the struct that out
+// points to from the script's global variables, instead of returning them.
+// See convert.DecodeStringDict for how fields are matched and converted.
+func EvalInto(src interface{}, globals map[string]interface{}, out interface{}, opts ...Option) error {
+	dict, err := evalDict(src, globals, opts)
+	if err != nil {
+		return err
+	}
+	return convert.DecodeStringDict(dict, out)
+}
+
+func evalDict(src interface{}, globals map[string]interface{}, opts []Option) (starlark.StringDict, error) {
+	cfg := makeConfig(opts)
 	dict, err := convert.MakeStringDict(globals)
 	if err != nil {
 		return nil, err
 	}
+	restrict(dict, cfg.policy)
+	thread := cfg.thread()
+	var filename string
+	switch s := src.(type) {
+	case string:
+		filename, src = s, nil
+	case io.Reader:
+		// read the source up front so errors can quote it.
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			return nil, err
+		}
+		filename, src = cfg.filename, b
+	default:
+		filename = cfg.filename
+	}
+	cfg.source = func(name string) []byte {
+		if b, ok := src.([]byte); ok && name == filename {
+			return b
+		}
+		b, _ := ioutil.ReadFile(name)
+		return b
+	}
+	return execThread(cfg, thread, func() (starlark.StringDict, error) {
+		return starlark.ExecFileOptions(&cfg.dialect, thread, filename, src, dict)
+	})
+}
+
+// thread returns a new starlark thread configured by cfg.
+func (cfg *config) thread() *starlark.Thread {
 	thread := &starlark.Thread{
-		Load: load,
+		Name:  cfg.name,
+		Print: cfg.print,
+		Load:  cfg.load,
 	}
-	filename, ok := src.(string)
-	if ok {
-		dict, err = starlark.ExecFile(thread, filename, nil, dict)
-	} else {
-		dict, err = starlark.ExecFile(thread, "eval.sky", src, dict)
+	for key, value := range cfg.locals {
+		thread.SetLocal(key, value)
 	}
-	if err != nil {
+	thread.SetLocal(convert.ContextLocal, cfg.ctx)
+	if cfg.interceptor != nil {
+		thread.SetLocal(convert.InterceptorLocal, cfg.interceptor)
+	}
+	if cfg.policy != nil {
+		thread.SetLocal(convert.PolicyLocal, cfg.policy)
+	}
+	return thread
+}
+
+// restrict makes the go values in dict follow p, if it isn't nil.
+func restrict(dict starlark.StringDict, p *convert.Policy) {
+	if p == nil {
+		return
+	}
+	for name, v := range dict {
+		dict[name] = convert.Restricted(v, p)
+	}
+}
+
+// execThread calls exec, cancelling thread if the configured context is done
+// or the thread exceeds the configured step limit before exec returns.
+// Starlark errors are returned as a *ScriptError.  If the thread was cancelled
+// because of the context, the returned error wraps ctx.Err(); if it was
+// cancelled because of the step limit, the error wraps ErrTooManySteps.
+func execThread(cfg config, thread *starlark.Thread, exec func() (starlark.StringDict, error)) (starlark.StringDict, error) {
+	ctx := cfg.ctx
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	return convert.FromStringDict(dict), nil
+	if cfg.limits.MaxSteps > 0 {
+		thread.SetMaxExecutionSteps(cfg.limits.MaxSteps)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-done:
+		}
+	}()
+	dict, err := exec()
+	steps := thread.ExecutionSteps()
+	if cfg.usage != nil {
+		*cfg.usage = Usage{Steps: steps}
+	}
+	if err != nil {
+		cause := err
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			cause = ctxErr
+		} else if cfg.limits.MaxSteps > 0 && steps >= cfg.limits.MaxSteps {
+			cause = ErrTooManySteps
+		}
+		return nil, scriptError(err, cause, cfg.source)
+	}
+	return dict, nil
 }
 
 // Cache is a cache of scripts to avoid re-reading files and reparsing them.
 type Cache struct {
-	dirs  []string
-	cache *cache
+	sources    []Source
+	namespaces map[string][]Source
+	cache      *cache
 
 	mu      sync.Mutex
 	scripts map[string]*starlark.Program
-}
+	stamps  map[string]stamp
+	cfg     config
 
-func run(p *starlark.Program, globals map[string]interface{}, load LoadFunc) (map[string]interface{}, error) {
-	g, err := convert.MakeStringDict(globals)
-	if err != nil {
-		return nil, err
-	}
-	ret, err := p.Init(&starlark.Thread{Load: load}, g)
-	if err != nil {
-		return nil, err
-	}
-	return convert.FromStringDict(ret), nil
+	listenMu  sync.Mutex
+	listeners []func(filename string)
 }
 
 // New returns a Starlight Cache that looks in the given directories for plugin
@@ -72,99 +201,365 @@ func run(p *starlark.Program, globals map[string]interface{}, load LoadFunc) (ma
 // called.  Calls to the script function load() will also look in these
 // directories. This function will panic if you give it no directories.
 func New(dirs ...string) *Cache {
-	if len(dirs) == 0 {
-		panic(fmt.Errorf("no directories given"))
+	c, err := NewCache(WithDirs(dirs...))
+	if err != nil {
+		panic(err)
 	}
-	return newCache(dirs, nil)
+	return c
 }
 
 // WithGlobals returns a new Starlight cache that passes the listed global
 // values to scripts loaded with the load() script function.  Note that these
 // globals will *not* be passed to individual scripts you run unless you
-// explicitly pass them in the Run call.
+// explicitly pass them in the Run call.  The globals are frozen, so scripts
+// can't change them.
 func WithGlobals(globals map[string]interface{}, dirs ...string) (*Cache, error) {
-	if len(dirs) == 0 {
+	return NewCache(WithModuleGlobals(globals), WithDirs(dirs...))
+}
+
+// NewCache returns a Starlight Cache configured by the given options.  The
+// directories and sources given with WithDirs, WithFS and WithSources are
+// searched in order for files when Run is called, and by the script function
+// load().  Other options set the defaults for every script the cache runs or
+// loads, and may be overridden per run with RunOptions.  It is an error to give
+// no directories or sources.
+func NewCache(opts ...Option) (*Cache, error) {
+	cfg := makeConfig(opts)
+	if len(cfg.sources) == 0 {
 		return nil, fmt.Errorf("no directories given")
 	}
-	g, err := convert.MakeStringDict(globals)
+	if cfg.observer == nil {
+		cfg.observer = nopObserver{}
+	}
+	g, err := convert.MakeStringDict(cfg.globals)
 	if err != nil {
 		return nil, err
 	}
-	return newCache(dirs, g), nil
-}
-
-func newCache(dirs []string, globals starlark.StringDict) *Cache {
+	restrict(g, cfg.policy)
+	// module globals are shared by every module, so no script may change them.
+	g.Freeze()
 	c := &Cache{
-		dirs:    dirs,
-		scripts: map[string]*starlark.Program{},
+		sources:    cfg.sources,
+		namespaces: cfg.ns,
+		scripts:    map[string]*starlark.Program{},
+		stamps:     map[string]stamp{},
+		cfg:        cfg,
 	}
 	c.cache = &cache{
 		cache:    make(map[string]*entry),
+		deps:     make(map[string]map[string]bool),
 		readFile: c.readFile,
-		globals:  globals,
+		globals:  g,
+		print:    cfg.print,
+		limits:   cfg.limits,
+		reload:   cfg.reload,
+		onReload: c.notifyReload,
+		compile:  c.compile,
+		resolve:  c.resolve,
+		observer: cfg.observer,
+
+		interceptor: cfg.interceptor,
+		policy:      cfg.policy,
 	}
-	return c
+	return c, nil
 }
 
 // Run looks for a file with the given filename, and runs it with the given globals
 // passed to the script's global namespace. The return value is all convertible
 // global variables from the script, which may include the passed-in globals.
+//
+// The filename is resolved like a name passed to load() from the root of the
+// cache's sources, so it may start with @name// to run a script in a
+// namespace.  It's an error for it to be an absolute path, or to lead outside
+// the sources with "..".
 func (c *Cache) Run(filename string, globals map[string]interface{}) (map[string]interface{}, error) {
+	return c.RunOptions(filename, globals)
+}
+
+// RunContext is like Run, but stops the script if ctx is done before the
+// script finishes.  In that case the returned error wraps ctx.Err().  Modules
+// the script loads for the first time with load() stop too; a module that
+// stops this way isn't cached, so the next script to load it loads it afresh.
+// This also applies to the module loaded by Call.
+func (c *Cache) RunContext(ctx context.Context, filename string, globals map[string]interface{}) (map[string]interface{}, error) {
+	return c.RunOptions(filename, globals, WithContext(ctx))
+}
+
+// RunLimits is like RunContext, but stops the script if it exceeds the given
+// limits instead of the limits set with SetLimits, and reports the resources
+// the script used.  The usage is reported even if the script fails.
+func (c *Cache) RunLimits(ctx context.Context, filename string, globals map[string]interface{}, limits Limits) (map[string]interface{}, Usage, error) {
+	var usage Usage
+	ret, err := c.RunOptions(filename, globals, WithContext(ctx), WithLimits(limits), WithUsage(&usage))
+	return ret, usage, err
+}
+
+// RunOptions is like Run, but configured by the given options, which override
+// the defaults given to NewCache.
+func (c *Cache) RunOptions(filename string, globals map[string]interface{}, opts ...Option) (map[string]interface{}, error) {
+	dict, err := c.run(filename, globals, opts)
+	if err != nil {
+		return nil, err
+	}
+	return convert.FromStringDict(dict), nil
+}
+
+// RunInto is like RunOptions, but fills the fields of the struct that out
+// points to from the script's global variables, instead of returning them.
+// See convert.DecodeStringDict for how fields are matched and converted.
+func (c *Cache) RunInto(filename string, globals map[string]interface{}, out interface{}, opts ...Option) error {
+	dict, err := c.run(filename, globals, opts)
+	if err != nil {
+		return err
+	}
+	return convert.DecodeStringDict(dict, out)
+}
+
+func (c *Cache) run(filename string, globals map[string]interface{}, opts []Option) (_ starlark.StringDict, err error) {
+	filename, err = c.resolve("", filename)
+	if err != nil {
+		return nil, err
+	}
+	defer c.observeRun(filename)(&err)
+	cfg := c.config(opts)
+	cfg.load = c.loader(filename)
+	cfg.source = c.source
+
 	dict, err := convert.MakeStringDict(globals)
 	if err != nil {
 		return nil, err
 	}
-	c.mu.Lock()
-	if p, ok := c.scripts[filename]; ok {
-		c.mu.Unlock()
-		return run(p, globals, c.load)
+	restrict(dict, cfg.policy)
+	p, err := c.program(filename, dict)
+	if err != nil {
+		return nil, err
 	}
-	c.mu.Unlock()
+	thread := cfg.thread()
+	return execThread(cfg, thread, func() (starlark.StringDict, error) {
+		return p.Init(thread, dict)
+	})
+}
 
-	b, err := c.readFile(filename)
+// Call loads the module with the given filename and calls the function with
+// the given name from the module's globals, passing it the given positional and
+// keyword arguments.  The return value is the go equivalent of the function's
+// return value.  The module is loaded the same way as with the load() script
+// function, so it is compiled and initialized only once, with the globals given
+// to WithGlobals, and it is shared with scripts that load it.  The filename is
+// resolved as with Run.
+func (c *Cache) Call(filename, name string, args []interface{}, kwargs map[string]interface{}, opts ...Option) (_ interface{}, err error) {
+	filename, err = c.resolve("", filename)
 	if err != nil {
 		return nil, err
 	}
-	_, p, err := starlark.SourceProgram(filename, b, dict.Has)
+	defer c.observeRun(filename)(&err)
+	cfg := c.config(opts)
+	cfg.load = c.loader(filename)
+	cfg.source = c.source
+
+	sargs, err := convert.MakeTuple(args)
 	if err != nil {
 		return nil, err
 	}
+	skwargs, err := convert.MakeKwargs(kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.policy != nil {
+		for i, v := range sargs {
+			sargs[i] = convert.Restricted(v, cfg.policy)
+		}
+		for _, kv := range skwargs {
+			kv[1] = convert.Restricted(kv[1], cfg.policy)
+		}
+	}
+	thread := cfg.thread()
+	globals, err := c.cache.Load(thread, filename)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := globals[name]
+	if !ok {
+		return nil, fmt.Errorf("%s has no global named %q", filename, name)
+	}
+	fn, ok := v.(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s global %q is a %s, not a function", filename, name, v.Type())
+	}
+	var ret starlark.Value
+	_, err = execThread(cfg, thread, func() (starlark.StringDict, error) {
+		var err error
+		ret, err = starlark.Call(thread, fn, sargs, skwargs)
+		return nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return convert.FromValue(ret), nil
+}
+
+// observeRun tells the cache's observer that a run of the given file has
+// started, and returns the function that tells it the run finished with the
+// error *err.
+func (c *Cache) observeRun(filename string) func(err *error) {
+	c.cfg.observer.RunStarted(filename)
+	start := time.Now()
+	return func(err *error) {
+		c.cfg.observer.RunFinished(filename, time.Since(start), *err)
+	}
+}
+
+// config returns the cache's default configuration, overridden by opts.
+func (c *Cache) config(opts []Option) config {
+	c.mu.Lock()
+	cfg := c.cfg
+	c.mu.Unlock()
+	cfg.apply(opts)
+	return cfg
+}
+
+// program returns the compiled program for the given filename, reading and
+// compiling it if it is not already cached.
+func (c *Cache) program(filename string, globals starlark.StringDict) (*starlark.Program, error) {
+	c.mu.Lock()
+	p, ok := c.scripts[filename]
+	s := c.stamps[filename]
+	reload := c.cfg.reload
+	c.mu.Unlock()
+	if ok && reload && s.changed() {
+		c.Forget(filename)
+		c.notifyReload(filename)
+		ok = false
+	}
+	c.cfg.observer.CacheLookup(ScriptCache, filename, ok)
+	if ok {
+		return p, nil
+	}
+
+	b, s, err := c.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err = c.compile(filename, b, globals)
+	if err != nil {
+		return nil, scriptError(err, err, c.source)
+	}
 	c.mu.Lock()
 	c.scripts[filename] = p
+	c.stamps[filename] = s
 	c.mu.Unlock()
-	return run(p, globals, c.load)
+	return p, nil
 }
 
-func (c *Cache) load(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-	return c.cache.Load(module)
+// SetLimits sets the limits for scripts run with Run and RunContext, and for
+// modules loaded with the load() script function.
+func (c *Cache) SetLimits(limits Limits) {
+	c.mu.Lock()
+	c.cfg.limits = limits
+	c.mu.Unlock()
+	c.cache.setLimits(limits)
+}
+
+// loader returns the function the script with the given filename uses to
+// load other scripts.
+func (c *Cache) loader(filename string) LoadFunc {
+	return func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+		module, err := c.resolve(filename, module)
+		if err != nil {
+			return nil, err
+		}
+		c.cache.addDep(filename, module)
+		return c.cache.Load(thread, module)
+	}
 }
 
-func (c *Cache) readFile(filename string) ([]byte, error) {
-	var err error
-	var b []byte
-	for _, d := range c.dirs {
-		b, err = ioutil.ReadFile(filepath.Join(d, filename))
+// readFile reads the script with the given canonical name from the first
+// source that has it.
+func (c *Cache) readFile(filename string) ([]byte, stamp, error) {
+	sources := c.sources
+	ns, name := splitNamespace(filename)
+	if ns != "" {
+		sources = c.namespaces[ns]
+	}
+	for _, src := range sources {
+		b, err := src.ReadFile(name)
 		if err == nil {
-			return b, nil
+			return b, makeStamp(src, name, b), nil
 		}
 	}
-	// guaranteed to have at least one directory, so there should be at least
-	// not found error here.
-	return nil, fmt.Errorf("cannot find file %q in any of the configured directories %q", filename, c.dirs)
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = sourceName(src)
+	}
+	return nil, stamp{}, fmt.Errorf("cannot find file %q in any of the configured sources %q", filename, names)
+}
+
+// source returns the source of the script with the given canonical name, or
+// nil if it cannot be read.
+func (c *Cache) source(filename string) []byte {
+	b, _, err := c.readFile(filename)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// RegisterModule makes the given go values available to scripts as a module
+// with the given name, which they can load with load(name, ...) instead of
+// having the values passed to every script as globals.  The members are
+// converted as with convert.MakeStringDict and frozen, so the module can be
+// shared safely by scripts running concurrently.  Registered modules take
+// precedence over script files with the same name.
+func (c *Cache) RegisterModule(name string, members map[string]interface{}) error {
+	dict, err := convert.MakeStringDict(members)
+	if err != nil {
+		return err
+	}
+	restrict(dict, c.cfg.policy)
+	dict.Freeze()
+	c.cache.register(name, dict)
+	return nil
+}
+
+// canonical returns the canonical name of filename, or filename itself if it
+// is not a valid name.
+func (c *Cache) canonical(filename string) string {
+	if name, err := c.resolve("", filename); err == nil {
+		return name
+	}
+	return filename
 }
 
 // Reset clears all cached scripts.
 func (c *Cache) Reset() {
 	c.mu.Lock()
 	c.scripts = map[string]*starlark.Program{}
+	c.stamps = map[string]stamp{}
 	c.cache.reset()
 	c.mu.Unlock()
 }
 
-// Forget clears the cached script for the given filename.
+// Forget clears the cached script for the given filename, along with every
+// cached script that loads it, directly or indirectly, since their globals may
+// depend on it.
 func (c *Cache) Forget(filename string) {
 	c.mu.Lock()
-	c.cache.remove(filename)
-	delete(c.scripts, filename)
+	for _, name := range c.cache.remove(c.canonical(filename)) {
+		delete(c.scripts, name)
+		delete(c.stamps, name)
+	}
 	c.mu.Unlock()
 }
+
+// Deps returns the sorted canonical filenames of the scripts that the script with the
+// given filename loads directly with load(), as of the last time it was run or
+// loaded.
+func (c *Cache) Deps(filename string) []string {
+	return c.cache.depsOf(c.canonical(filename))
+}
+
+// Dependents returns the sorted canonical filenames of the cached scripts that load the
+// script with the given filename directly with load().
+func (c *Cache) Dependents(filename string) []string {
+	return c.cache.dependentsOf(c.canonical(filename))
+}
@@ -1,11 +1,24 @@
 package starlight
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/starlight-go/starlight/convert"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 func TestConversion(t *testing.T) {
@@ -154,6 +167,1017 @@ func TestEval(t *testing.T) {
 	}
 }
 
+const spin = `
+def spin():
+	for x in range(1000000000):
+		pass
+spin()
+`
+
+func TestEvalContextCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := EvalContext(ctx, []byte(spin), nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected error wrapping context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	dir, cleanup := makeScript(t, "spin.star", spin)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := New(dir).RunContext(ctx, "spin.star", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error wrapping context.Canceled, got %v", err)
+	}
+}
+
+func TestRunContextCancelsLoad(t *testing.T) {
+	var mu sync.Mutex
+	reads := 0
+	src := SourceFunc(func(name string) ([]byte, error) {
+		switch name {
+		case "main.star":
+			return []byte(`load("spin.star", "spin")`), nil
+		case "spin.star":
+			mu.Lock()
+			reads++
+			mu.Unlock()
+			return []byte(spin), nil
+		}
+		return nil, os.ErrNotExist
+	})
+	s, err := NewCache(WithSources(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, run := range []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			_, err := s.RunContext(ctx, "main.star", nil)
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := s.Call("spin.star", "spin", nil, nil, WithContext(ctx))
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := run(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("run %d: expected error wrapping context.DeadlineExceeded, got %v", i, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Fatalf("run %d: took %v to stop", i, d)
+		}
+	}
+	// a cancelled module isn't cached, so each run loads it afresh.
+	mu.Lock()
+	defer mu.Unlock()
+	if reads != 2 {
+		t.Fatalf("expected spin.star to be read twice, got %d", reads)
+	}
+}
+
+func TestEvalLimits(t *testing.T) {
+	_, usage, err := EvalLimits(context.Background(), []byte(spin), nil, nil, Limits{MaxSteps: 1000})
+	if !errors.Is(err, ErrTooManySteps) {
+		t.Fatalf("expected error wrapping ErrTooManySteps, got %v", err)
+	}
+	if usage.Steps < 1000 {
+		t.Fatalf("expected at least 1000 steps used, got %d", usage.Steps)
+	}
+
+	v, usage, err := EvalLimits(context.Background(), []byte(`output = 1 + 2`), nil, nil, Limits{MaxSteps: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != int64(3) {
+		t.Fatalf("expected 3 but got %v", v["output"])
+	}
+	if usage.Steps == 0 || usage.Steps >= 1000 {
+		t.Fatalf("expected a small nonzero number of steps, got %d", usage.Steps)
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	dir, cleanup := makeScript(t, "spin.star", spin)
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(dir, "main.star"), []byte(`load("spin.star", "spin")`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(dir)
+	s.SetLimits(Limits{MaxSteps: 1000})
+	_, err = s.Run("main.star", nil)
+	if !errors.Is(err, ErrTooManySteps) {
+		t.Fatalf("expected error wrapping ErrTooManySteps, got %v", err)
+	}
+}
+
+func TestEvalOptions(t *testing.T) {
+	var printed []string
+	var threadName string
+	print := func(thread *starlark.Thread, msg string) {
+		threadName = thread.Name
+		printed = append(printed, msg)
+	}
+	_, err := EvalOptions([]byte(`print("hi")`), nil, WithPrint(print), WithThreadName("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(printed, []string{"hi"}) {
+		t.Fatalf(`expected ["hi"] to be printed, but got %q`, printed)
+	}
+	if threadName != "test" {
+		t.Fatalf(`expected thread name "test" but got %q`, threadName)
+	}
+
+	_, err = EvalOptions([]byte(`output = nope`), nil, WithFilename("custom.star"))
+	if err == nil || !strings.Contains(err.Error(), "custom.star") {
+		t.Fatalf("expected error mentioning custom.star, got %v", err)
+	}
+}
+
+func TestNewCacheOptions(t *testing.T) {
+	dir, cleanup := makeScript(t, "lib.star", `print("loading lib")
+greeting = "hello"`)
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(dir, "main.star"), []byte(`load("lib.star", "greeting")
+output = greeting`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var printed []string
+	print := func(_ *starlark.Thread, msg string) { printed = append(printed, msg) }
+	s, err := NewCache(WithDirs(dir), WithPrint(print))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.RunOptions("main.star", nil, WithThreadName("main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "hello" {
+		t.Fatalf(`expected "hello" but got %q`, v["output"])
+	}
+	if !reflect.DeepEqual(printed, []string{"loading lib"}) {
+		t.Fatalf(`expected ["loading lib"] to be printed, but got %q`, printed)
+	}
+
+	if _, err := NewCache(); err == nil {
+		t.Fatal("expected error creating cache with no directories")
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	dir, cleanup := makeScript(t, "lib.star", `print("loading lib")
+greeting = "hello"`)
+	defer cleanup()
+	err := ioutil.WriteFile(filepath.Join(dir, "main.star"), []byte(`load("lib.star", "greeting")
+print(greeting)`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(dir)
+
+	var files, msgs []string
+	print := func(_ *starlark.Thread, filename, msg string) {
+		files = append(files, filename)
+		msgs = append(msgs, msg)
+	}
+	if _, err := s.RunOptions("main.star", nil, WithPrintFunc(print)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"lib.star", "main.star"}) {
+		t.Errorf(`expected prints from ["lib.star" "main.star"], but got %q`, files)
+	}
+	if !reflect.DeepEqual(msgs, []string{"loading lib", "hello"}) {
+		t.Errorf(`expected ["loading lib" "hello"] to be printed, but got %q`, msgs)
+	}
+
+	// lib.star is already loaded, so only main.star prints this time.
+	var buf bytes.Buffer
+	if _, err := s.RunOptions("main.star", nil, WithOutput(&buf)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello\n" {
+		t.Errorf(`expected "hello\n" to be printed, but got %q`, buf.String())
+	}
+}
+
+func TestCall(t *testing.T) {
+	dir, cleanup := makeScript(t, "plugin.star", `
+def transform(record, suffix="!"):
+	return record["name"] + suffix
+
+count = 5
+`)
+	defer cleanup()
+	s := New(dir)
+
+	v, err := s.Call("plugin.star", "transform",
+		[]interface{}{map[string]string{"name": "bob"}},
+		map[string]interface{}{"suffix": "?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "bob?" {
+		t.Fatalf(`expected "bob?" but got %q`, v)
+	}
+
+	if _, err := s.Call("plugin.star", "missing", nil, nil); err == nil {
+		t.Fatal("expected error calling missing function")
+	}
+	if _, err := s.Call("plugin.star", "count", nil, nil); err == nil {
+		t.Fatal("expected error calling non-function")
+	}
+}
+
+func TestRunInto(t *testing.T) {
+	dir, cleanup := makeScript(t, "out.star", `
+total = len(items)
+names = [i + "!" for i in items]
+`)
+	defer cleanup()
+
+	var out struct {
+		Total int      `starlark:"total"`
+		Names []string `starlark:"names"`
+	}
+	err := New(dir).RunInto("out.star", map[string]interface{}{"items": []string{"a", "b"}}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Total != 2 || !reflect.DeepEqual(out.Names, []string{"a!", "b!"}) {
+		t.Fatalf("unexpected output %#v", out)
+	}
+}
+
+func TestEvalInto(t *testing.T) {
+	var out struct{ Output int8 }
+	err := EvalInto([]byte(`Output = 1000`), nil, &out)
+	if err == nil || !strings.Contains(err.Error(), "Output") {
+		t.Fatalf("expected error mentioning Output, got %v", err)
+	}
+}
+
+func TestAutoReload(t *testing.T) {
+	dir, cleanup := makeScript(t, "lib.star", `greeting = "hello"`)
+	defer cleanup()
+	writeScript(t, dir, "main.star", `load("lib.star", "greeting")
+output = greeting + " world"`)
+
+	s, err := NewCache(WithDirs(dir), WithAutoReload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reloaded []string
+	s.OnReload(func(filename string) { reloaded = append(reloaded, filename) })
+
+	v, err := s.Run("main.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "hello world" {
+		t.Fatalf(`expected "hello world" but got %q`, v["output"])
+	}
+
+	writeScript(t, dir, "lib.star", `greeting = "goodbye"`)
+	v, err = s.Run("main.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "goodbye world" {
+		t.Fatalf(`expected "goodbye world" but got %q`, v["output"])
+	}
+
+	writeScript(t, dir, "main.star", `output = "changed"`)
+	v, err = s.Run("main.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "changed" {
+		t.Fatalf(`expected "changed" but got %q`, v["output"])
+	}
+	if !reflect.DeepEqual(reloaded, []string{"lib.star", "main.star"}) {
+		t.Fatalf(`expected reloads of ["lib.star" "main.star"], but got %q`, reloaded)
+	}
+}
+
+func TestAutoReloadDoesNotBlock(t *testing.T) {
+	var mu sync.Mutex
+	var block chan struct{}
+	entered := make(chan struct{})
+	src := SourceFunc(func(name string) ([]byte, error) {
+		switch name {
+		case "a.star":
+			return []byte(`load("slow.star", "x")`), nil
+		case "b.star":
+			return []byte(`load("fast.star", "y")`), nil
+		case "slow.star":
+			mu.Lock()
+			b := block
+			mu.Unlock()
+			if b != nil {
+				close(entered)
+				<-b
+			}
+			return []byte(`x = 1`), nil
+		case "fast.star":
+			return []byte(`y = 2`), nil
+		}
+		return nil, os.ErrNotExist
+	})
+	s, err := NewCache(WithSources(src), WithAutoReload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.star", "b.star"} {
+		if _, err := s.Run(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// checking slow.star for changes mustn't stop other modules loading.
+	release := make(chan struct{})
+	mu.Lock()
+	block = release
+	mu.Unlock()
+	done := make(chan error)
+	go func() {
+		_, err := s.Run("a.star", nil)
+		done <- err
+	}()
+	<-entered
+	mu.Lock()
+	block = nil
+	mu.Unlock()
+	finished := make(chan error)
+	go func() {
+		_, err := s.Run("b.star", nil)
+		finished <- err
+	}()
+	select {
+	case err := <-finished:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loading fast.star waited for slow.star to be checked")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, cleanup := makeScript(t, "foo.star", `output = "hi"`)
+	defer cleanup()
+	s := New(dir)
+	reloaded := make(chan string, 1)
+	s.OnReload(func(filename string) { reloaded <- filename })
+	stop := s.Watch(10 * time.Millisecond)
+	defer stop()
+
+	if _, err := s.Run("foo.star", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeScript(t, dir, "foo.star", `output = "bye"`)
+	select {
+	case filename := <-reloaded:
+		if filename != "foo.star" {
+			t.Fatalf(`expected reload of "foo.star", but got %q`, filename)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+	v, err := s.Run("foo.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "bye" {
+		t.Fatalf(`expected "bye" but got %q`, v["output"])
+	}
+}
+
+func TestWatchFailedLoad(t *testing.T) {
+	dir, cleanup := makeScript(t, "lib.star", `greeting = `)
+	defer cleanup()
+	writeScript(t, dir, "main.star", `load("lib.star", "greeting")
+output = greeting`)
+	s := New(dir)
+	if _, err := s.Run("main.star", nil); err == nil {
+		t.Fatal("expected an error loading lib.star")
+	}
+	reloaded := make(chan string, 1)
+	s.OnReload(func(filename string) { reloaded <- filename })
+	writeScript(t, dir, "lib.star", `greeting = "hi"`)
+	stop := s.Watch(10 * time.Millisecond)
+	select {
+	case filename := <-reloaded:
+		if filename != "lib.star" {
+			t.Fatalf(`expected reload of "lib.star", but got %q`, filename)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+	stop()
+	// stopping twice must not panic.
+	stop()
+	v, err := s.Run("main.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "hi" {
+		t.Fatalf(`expected "hi" but got %q`, v["output"])
+	}
+}
+
+func TestForgetDependents(t *testing.T) {
+	dir, cleanup := makeScript(t, "lib.star", `greeting = "hello"`)
+	defer cleanup()
+	writeScript(t, dir, "mid.star", `load("lib.star", "greeting")
+message = greeting + " world"`)
+	writeScript(t, dir, "main.star", `load("mid.star", "message")
+output = message`)
+	writeScript(t, dir, "other.star", `output = "other"`)
+
+	s := New(dir)
+	for _, name := range []string{"main.star", "other.star"} {
+		if _, err := s.Run(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deps := s.Deps("main.star"); !reflect.DeepEqual(deps, []string{"mid.star"}) {
+		t.Fatalf(`expected main.star deps ["mid.star"], but got %q`, deps)
+	}
+	if deps := s.Dependents("lib.star"); !reflect.DeepEqual(deps, []string{"mid.star"}) {
+		t.Fatalf(`expected lib.star dependents ["mid.star"], but got %q`, deps)
+	}
+
+	writeScript(t, dir, "lib.star", `greeting = "goodbye"`)
+	writeScript(t, dir, "other.star", `output = "changed"`)
+	s.Forget("lib.star")
+
+	v, err := s.Run("main.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "goodbye world" {
+		t.Fatalf(`expected "goodbye world" but got %q`, v["output"])
+	}
+	// other.star doesn't load lib.star, so it should still be cached.
+	v, err = s.Run("other.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "other" {
+		t.Fatalf(`expected "other" but got %q`, v["output"])
+	}
+}
+
+func TestCompileCache(t *testing.T) {
+	dir, cleanup := makeScript(t, "foo.star", `output = "from source"`)
+	defer cleanup()
+	compiled := filepath.Join(dir, "compiled")
+
+	s, err := NewCache(WithDirs(dir), WithCompileCache(compiled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run("foo.star", nil); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(compiled, "*.starc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 compiled file, but got %q", files)
+	}
+
+	// replace the compiled program, to prove a new cache reads it instead of
+	// the source.
+	_, p, err := starlark.SourceProgram("foo.star", `output = "from disk"`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[0], buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewCache(WithDirs(dir), WithCompileCache(compiled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.Run("foo.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "from disk" {
+		t.Fatalf(`expected "from disk" but got %q`, v["output"])
+	}
+
+	// a corrupt compiled program is ignored.
+	if err := ioutil.WriteFile(files[0], []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewCache(WithDirs(dir), WithCompileCache(compiled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = s.Run("foo.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "from source" {
+		t.Fatalf(`expected "from source" but got %q`, v["output"])
+	}
+}
+
+func TestSources(t *testing.T) {
+	fsys := fstest.MapFS{
+		"foo.star": &fstest.MapFile{Data: []byte(`load("lib.star", "greeting")
+output = greeting + " from fs"`)},
+	}
+	lib := `greeting = "hello"`
+	db := SourceFunc(func(name string) ([]byte, error) {
+		if name == "lib.star" {
+			return []byte(lib), nil
+		}
+		return nil, os.ErrNotExist
+	})
+
+	s, err := NewCache(WithFS(fsys), WithDirs("testdata"), WithSources(db), WithAutoReload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// foo.star is in both fsys and testdata, so the first source wins.
+	v, err := s.Run("foo.star", map[string]interface{}{"input": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "hello from fs" {
+		t.Fatalf(`expected "hello from fs" but got %q`, v["output"])
+	}
+
+	// sources that can't stat their files are checked by content.
+	lib = `greeting = "goodbye"`
+	v, err = s.Run("foo.star", map[string]interface{}{"input": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "goodbye from fs" {
+		t.Fatalf(`expected "goodbye from fs" but got %q`, v["output"])
+	}
+
+	if _, err := s.Run("missing.star", nil); err == nil {
+		t.Fatal("expected error running missing file")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	fsys := fstest.MapFS{
+		"plugins/a/main.star": &fstest.MapFile{Data: []byte(`
+load("./util.star", "name")
+load("//lib/common.star", "common")
+load("@shared//greet.star", "greet")
+output = greet(name) + common`)},
+		"plugins/a/util.star": &fstest.MapFile{Data: []byte(`name = "a"`)},
+		"plugins/b/main.star": &fstest.MapFile{Data: []byte(`
+load("./util.star", "name")
+load("../../lib/common.star", "common")
+output = name + common`)},
+		"plugins/b/util.star": &fstest.MapFile{Data: []byte(`name = "b"`)},
+		"lib/common.star":     &fstest.MapFile{Data: []byte(`common = "!"`)},
+		"escape.star":         &fstest.MapFile{Data: []byte(`load("../secret.star", "x")`)},
+	}
+	shared := fstest.MapFS{
+		"greet.star": &fstest.MapFile{Data: []byte(`
+load("./names.star", "prefix")
+def greet(name):
+	return prefix + name`)},
+		"names.star": &fstest.MapFile{Data: []byte(`prefix = "hello "`)},
+	}
+	s, err := NewCache(WithFS(fsys), WithNamespace("shared", FS(shared)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"plugins/a/main.star": "hello a!",
+		"plugins/b/main.star": "b!",
+	}
+	for name, expected := range tests {
+		v, err := s.Run(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v["output"] != expected {
+			t.Errorf("%s: expected %q but got %q", name, expected, v["output"])
+		}
+	}
+	deps := s.Deps("plugins/a/main.star")
+	expected := []string{"@shared//greet.star", "lib/common.star", "plugins/a/util.star"}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Errorf("expected deps %q, but got %q", expected, deps)
+	}
+	if deps := s.Deps("@shared//greet.star"); !reflect.DeepEqual(deps, []string{"@shared//names.star"}) {
+		t.Errorf(`expected deps ["@shared//names.star"], but got %q`, deps)
+	}
+
+	if _, err := s.Run("escape.star", nil); err == nil {
+		t.Error("expected error loading a file outside the sources")
+	}
+	if _, err := s.Run("@unknown//x.star", nil); err == nil {
+		t.Error("expected error running a file in an unknown namespace")
+	}
+	for _, name := range []string{"../secret.star", "/lib/common.star", "plugins/../../secret.star"} {
+		_, err := s.Run(name, nil)
+		expected := fmt.Sprintf("invalid module name %q: must be a file within the configured sources", name)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%s: expected error %q, got %v", name, expected, err)
+		}
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	dir, cleanup := makeScript(t, "main.star", `
+load("billing", "charge")
+output = charge(10)`)
+	defer cleanup()
+	s := New(dir)
+	err := s.RegisterModule("billing", map[string]interface{}{
+		"charge": func(amount int) string { return fmt.Sprintf("charged %d", amount) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.Run("main.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "charged 10" {
+		t.Fatalf(`expected "charged 10" but got %q`, v["output"])
+	}
+
+	// registered modules aren't globals.
+	writeScript(t, dir, "other.star", `output = charge(10)`)
+	if _, err := s.Run("other.star", nil); err == nil {
+		t.Fatal("expected error using a module member as a global")
+	}
+}
+
+func TestScriptError(t *testing.T) {
+	errNoFunds := errors.New("insufficient funds")
+	dir, cleanup := makeScript(t, "main.star", `
+def pay(amount):
+	return charge(amount)
+
+pay(10)
+`)
+	defer cleanup()
+	s := New(dir)
+	_, err := s.Run("main.star", map[string]interface{}{
+		"charge": func(amount int) error { return errNoFunds },
+	})
+	if !errors.Is(err, errNoFunds) {
+		t.Fatalf("expected error to wrap %v, got %v", errNoFunds, err)
+	}
+	var serr *ScriptError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected *ScriptError, got %T", err)
+	}
+	if serr.Filename != "main.star" || serr.Line != 3 || serr.Col != 15 {
+		t.Errorf("expected position main.star:3:15, got %s:%d:%d", serr.Filename, serr.Line, serr.Col)
+	}
+	if serr.Snippet != "\treturn charge(amount)\n\t             ^" {
+		t.Errorf("unexpected snippet:\n%s", serr.Snippet)
+	}
+	if !strings.Contains(serr.Backtrace, "in pay") {
+		t.Errorf("expected backtrace to mention pay, got:\n%s", serr.Backtrace)
+	}
+
+	// errors in loaded modules are reachable too.
+	writeScript(t, dir, "lib.star", "x = 1 // 0\n")
+	writeScript(t, dir, "user.star", `load("lib.star", "x")`)
+	_, err = s.Run("user.star", nil)
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected *ScriptError, got %T", err)
+	}
+	var inner *ScriptError
+	if !errors.As(serr.Err, &inner) || inner.Filename != "lib.star" || inner.Line != 1 {
+		t.Fatalf("expected error from lib.star:1, got %#v", inner)
+	}
+}
+
+func TestScriptErrorCompile(t *testing.T) {
+	_, err := EvalOptions([]byte("x = 1\ny = (\n"), nil, WithFilename("bad.star"))
+	var serr *ScriptError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected *ScriptError, got %T: %v", err, err)
+	}
+	if serr.Filename != "bad.star" || serr.Line != 3 {
+		t.Errorf("expected position bad.star:3, got %s:%d", serr.Filename, serr.Line)
+	}
+	if serr.Backtrace != "" {
+		t.Errorf("expected no backtrace for compile error, got:\n%s", serr.Backtrace)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.star":       {Data: []byte(`load("lib/util.star", "f")` + "\noutput = f(input)")},
+		"lib/util.star":   {Data: []byte(`load("./missing.star", "g")` + "\ndef f(x):\n\treturn x")},
+		"bad.star":        {Data: []byte("x = (")},
+		"undefined.star":  {Data: []byte("x = nope")},
+		"a.star":          {Data: []byte(`load("b.star", "b")` + "\na = 1")},
+		"b.star":          {Data: []byte(`load("a.star", "a")` + "\nb = 1")},
+		"billing.star":    {Data: []byte(`load("billing", "charge")`)},
+		"uses.star":       {Data: []byte(`load("lib/input.star", "x")` + "\n" + `load("hidden.star", "y")` + "\n" + `load("lib/secret.star", "z")`)},
+		"lib/input.star":  {Data: []byte("x = input")},
+		"lib/secret.star": {Data: []byte("z = secret")},
+		"secret.star":     {Data: []byte("x = secret")},
+		"notes.txt":       {Data: []byte("not a script")},
+	}
+	hidden := SourceFunc(func(name string) ([]byte, error) {
+		if name == "hidden.star" {
+			return []byte("y = input"), nil
+		}
+		return nil, os.ErrNotExist
+	})
+	s, err := NewCache(WithFS(fsys), WithSources(hidden), WithModuleGlobals(map[string]interface{}{"secret": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterModule("billing", map[string]interface{}{"charge": func() {}}); err != nil {
+		t.Fatal(err)
+	}
+	errs := s.Check("input")
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	expected := []string{
+		"bad.star:1:6: got end of file, want primary expression",
+		// scripts that are run don't get the module globals...
+		"secret.star:1:5: undefined: secret",
+		"undefined.star:1:5: undefined: nope",
+		// ...and modules only get the module globals, not the names
+		// given to Run.
+		"hidden.star:1:5: undefined: input",
+		"lib/input.star:1:5: undefined: input",
+		"lib/util.star:1:6: cannot load ./missing.star: ",
+		"cycle in load graph: a.star -> b.star -> a.star",
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d:\n%s", len(expected), len(msgs), strings.Join(msgs, "\n"))
+	}
+	for i := range expected {
+		if !strings.HasPrefix(msgs[i], expected[i]) {
+			t.Errorf("expected error %d to start with %q, got %q", i, expected[i], msgs[i])
+		}
+	}
+	var serr *ScriptError
+	if !errors.As(errs[5], &serr) || serr.Snippet == "" {
+		t.Errorf("expected a ScriptError with a snippet for the missing load, got %#v", errs[5])
+	}
+}
+
+func TestPreload(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.star":   {Data: []byte("output = input + 1")},
+		"b.star":   {Data: []byte("output = input * 2")},
+		"bad.star": {Data: []byte("x = (")},
+	}
+	s, err := NewCache(WithFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := s.Preload("input")
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "bad.star:") {
+		t.Fatalf("expected only an error for bad.star, got %v", errs)
+	}
+	s.mu.Lock()
+	n := len(s.scripts)
+	s.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 preloaded scripts, got %d", n)
+	}
+	v, err := s.Run("b.star", map[string]interface{}{"input": 21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != int64(42) {
+		t.Fatalf("expected 42, got %v", v["output"])
+	}
+}
+
+func TestPreloadModuleGlobals(t *testing.T) {
+	fsys := fstest.MapFS{"main.star": {Data: []byte("x = secret")}}
+	s, err := NewCache(WithFS(fsys), WithModuleGlobals(map[string]interface{}{"secret": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// scripts that are run don't get the module globals, so they mustn't
+	// compile against them.
+	errs := s.Preload()
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "main.star:1:5: undefined: secret") {
+		t.Fatalf("expected an error for main.star, got %v", errs)
+	}
+	_, err = s.Run("main.star", nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "main.star:1:5: undefined: secret") {
+		t.Fatalf("expected undefined: secret, got %v", err)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	if resolve.AllowSet || resolve.AllowGlobalReassign || resolve.AllowRecursion {
+		t.Fatal("expected starlight not to change the global resolve flags")
+	}
+	code := []byte(`
+def count(n):
+	i = 0
+	while i < n:
+		i += 1
+	return i
+
+output = count(3)
+`)
+	if _, err := EvalOptions(code, nil); err == nil {
+		t.Fatal("expected error using while without enabling it")
+	}
+	v, err := EvalOptions(code, nil, WithDialect(syntax.FileOptions{While: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != int64(3) {
+		t.Fatalf("expected 3, got %v", v["output"])
+	}
+
+	dir, cleanup := makeScript(t, "fact.star", `
+def fact(n):
+	return 1 if n <= 1 else n * fact(n-1)
+
+output = fact(5)
+s = set([1])
+`)
+	defer cleanup()
+	if _, err := New(dir).Run("fact.star", nil); err == nil {
+		t.Fatal("expected error using recursion without enabling it")
+	}
+	s, err := NewCache(WithDirs(dir), WithDialect(syntax.FileOptions{Recursion: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run("fact.star", nil); err == nil || !strings.Contains(err.Error(), "set") {
+		t.Fatalf("expected error using set without enabling it, got %v", err)
+	}
+	s, err = NewCache(WithDirs(dir), WithDialect(syntax.FileOptions{Recursion: true, Set: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = s.Run("fact.star", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != int64(120) {
+		t.Fatalf("expected 120, got %v", v["output"])
+	}
+}
+
+func TestModuleGlobalsFrozen(t *testing.T) {
+	type config struct{ Env string }
+	cfg := &config{Env: "prod"}
+	dir, cleanup := makeScript(t, "lib.star", `
+def env():
+	return cfg.Env
+cfg.Env = "dev"
+`)
+	defer cleanup()
+	writeScript(t, dir, "main.star", `load("lib.star", "env")`)
+	s, err := WithGlobals(map[string]interface{}{"cfg": cfg}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Run("main.star", nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot set field Env of frozen struct") {
+		t.Fatalf("expected error changing a module global, got %v", err)
+	}
+	if cfg.Env != "prod" {
+		t.Fatalf("module global was changed to %q", cfg.Env)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.star": {Data: []byte(`load("lib.star", "x")` + "\noutput = x")},
+		"lib.star":  {Data: []byte(`x = 1`)},
+		"a.star":    {Data: []byte(`load("b.star", "b")`)},
+		"b.star":    {Data: []byte(`load("a.star", "a")`)},
+	}
+	m := NewMetrics(time.Millisecond, time.Second)
+	s, err := NewCache(WithFS(fsys), WithObserver(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Run("main.star", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Call("a.star", "a", nil, nil); err == nil {
+		t.Fatal("expected error from load cycle")
+	}
+
+	snap := m.Snapshot()
+	expected := MetricsSnapshot{
+		Compiles:     4, // main, lib, a, b
+		ScriptHits:   1,
+		ScriptMisses: 1,
+		ModuleHits:   2, // lib on the second run, and a when b loads it
+		ModuleMisses: 3, // lib, a, b
+		LoadCycles:   1,
+		Runs:         3,
+		RunErrors:    1,
+	}
+	got := snap
+	got.CompileTime, got.RunTime = Histogram{}, Histogram{}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected\n%+v\ngot\n%+v", expected, got)
+	}
+	if snap.RunTime.Count != 3 || len(snap.RunTime.Counts) != 3 {
+		t.Errorf("unexpected run time histogram %+v", snap.RunTime)
+	}
+	if snap.CompileTime.Count != 4 {
+		t.Errorf("unexpected compile time histogram %+v", snap.CompileTime)
+	}
+}
+
+func TestMetricsZero(t *testing.T) {
+	m := &Metrics{}
+	s, err := NewCache(WithFS(fstest.MapFS{"main.star": {Data: []byte(`x = 1`)}}), WithObserver(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run("main.star", nil); err != nil {
+		t.Fatal(err)
+	}
+	snap := m.Snapshot()
+	if snap.Runs != 1 || snap.RunTime.Count != 1 || len(snap.RunTime.Counts) != len(DefaultBuckets)+1 {
+		t.Errorf("unexpected run time histogram %+v", snap.RunTime)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	type user struct{ Name, Password string }
+	p := convert.NewPolicy().Deny("*", "Password")
+	globals := map[string]interface{}{
+		"me":     &user{Name: "bob", Password: "hunter2"},
+		"lookup": func(name string) *user { return &user{Name: name, Password: "swordfish"} },
+	}
+	for _, code := range []string{"me.Password", `lookup("alice").Password`} {
+		_, err := EvalOptions([]byte(code), globals, WithPolicy(p))
+		if err == nil || !strings.Contains(err.Error(), "has no .Password field or method (not allowed by policy)") {
+			t.Errorf("%s: expected policy error, got %v", code, err)
+		}
+	}
+	v, err := EvalOptions([]byte(`output = lookup("alice").Name`), globals, WithPolicy(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v["output"] != "alice" {
+		t.Fatalf("expected alice, got %v", v["output"])
+	}
+}
+
+// writeScript writes a script to dir, making sure its modification time
+// changes even on filesystems with coarse timestamps.
+func writeScript(t *testing.T, dir, name, data string) {
+	filename := filepath.Join(dir, name)
+	modTime := time.Now()
+	if fi, err := os.Stat(filename); err == nil {
+		modTime = fi.ModTime().Add(time.Second)
+	}
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func makeScript(t *testing.T, name, data string) (dir string, cleanup func()) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {